@@ -0,0 +1,279 @@
+// bulk.go
+package fsql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// GetBulkUpdateQuery builds a single UPDATE applying per-row values joined on keyCol.
+// Every row must hold keyCol and the same update columns as the first row.
+// The VALUES list is unioned with an empty select of the table so the placeholders take the column types.
+// It is not tenant scoped; BulkUpdateContext is.
+func GetBulkUpdateQuery(tableName, keyCol string, rows []map[string]interface{}) (string, []interface{}, error) {
+	return getBulkUpdateQuery(WithoutTenant(context.Background()), tableName, keyCol, rows, false)
+}
+
+// getBulkUpdateQuery restricts the update to the tenant of ctx and optionally adds the 1-based
+// position of each row as the v.ordinal column
+func getBulkUpdateQuery(ctx context.Context, tableName, keyCol string, rows []map[string]interface{}, ordinal bool) (string, []interface{}, error) {
+	modelInfo, ok := getModelInfo(tableName)
+	if !ok {
+		return "", nil, fmt.Errorf("table name not initialized: %s", tableName)
+	}
+	if _, ok := modelInfo.dbFieldsSelectMap[keyCol]; !ok {
+		return "", nil, fmt.Errorf("unknown key column %s on table %s", keyCol, tableName)
+	}
+	if len(rows) == 0 {
+		return "", nil, fmt.Errorf("no rows to update for table %s", tableName)
+	}
+
+	columns := []string{}
+	for _, field := range modelInfo.dbFieldsUpdate {
+		if _, ok := rows[0][field]; ok && field != keyCol {
+			columns = append(columns, field)
+		}
+	}
+	if len(columns) == 0 {
+		return "", nil, fmt.Errorf("no fields to update for table %s", tableName)
+	}
+
+	allColumns := append([]string{keyCol}, columns...)
+	quotedColumns := make([]string, len(allColumns))
+	for i, column := range allColumns {
+		quotedColumns[i] = QuoteIdentifier(column)
+	}
+	selectColumns, valuesColumns := strings.Join(quotedColumns, ","), strings.Join(quotedColumns, ",")
+	if ordinal {
+		selectColumns += ",0"
+		valuesColumns += `,"ordinal"`
+	}
+
+	values := []string{}
+	queryValues := []interface{}{}
+	counter := 1
+	for i, row := range rows {
+		if len(row) != len(rows[0]) {
+			return "", nil, fmt.Errorf("row %d has different columns than the first row", i)
+		}
+		for _, column := range allColumns {
+			value, ok := row[column]
+			if !ok {
+				return "", nil, fmt.Errorf("row %d is missing column %s", i, column)
+			}
+			queryValues = append(queryValues, value)
+		}
+		placeholders := Placeholders(counter, len(allColumns))
+		if ordinal {
+			placeholders = append(placeholders, fmt.Sprintf("%d", i+1))
+		}
+		values = append(values, "("+strings.Join(placeholders, ",")+")")
+		counter += len(allColumns)
+	}
+
+	setClauses := make([]string, len(columns))
+	for i, column := range columns {
+		setClauses[i] = fmt.Sprintf(`%s = v.%s`, QuoteIdentifier(column), QuoteIdentifier(column))
+	}
+
+	quotedTableName := quoteTable(tableName)
+	query := fmt.Sprintf(`UPDATE %s SET %s FROM (SELECT %s FROM %s WHERE false UNION ALL VALUES %s) AS v(%s) WHERE %s.%s = v.%s`,
+		quotedTableName, strings.Join(setClauses, ", "),
+		selectColumns, quotedTableName, strings.Join(values, ","),
+		valuesColumns, quotedTableName, QuoteIdentifier(keyCol), QuoteIdentifier(keyCol))
+
+	conditions, tenantArgs, err := tenantConditions(ctx, tableName, counter)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, condition := range conditions {
+		query += " AND " + condition
+	}
+	return query, append(queryValues, tenantArgs...), nil
+}
+
+// BulkUpdateReturning executes GetBulkUpdateQuery and scans the returning columns of the updated
+// rows into dest, a pointer to a slice, in the order of rows. Returning columns hold the values
+// after the update, and may include keyCol to match them to their input row.
+func BulkUpdateReturning(dest interface{}, tableName, keyCol string, rows []map[string]interface{}, returning ...string) error {
+	return BulkUpdateReturningContext(context.Background(), dest, tableName, keyCol, rows, returning...)
+}
+
+// BulkUpdateReturningContext is BulkUpdateReturning restricted to the tenant of ctx
+func BulkUpdateReturningContext(ctx context.Context, dest interface{}, tableName, keyCol string, rows []map[string]interface{}, returning ...string) error {
+	query, args, err := getBulkUpdateReturningQuery(ctx, tableName, keyCol, rows, returning)
+	if err != nil {
+		return err
+	}
+	return SelectContext(WithQueryTable(ctx, tableName), dest, query, args...)
+}
+
+// getBulkUpdateReturningQuery wraps the update in a CTE to sort its returned rows by input position
+func getBulkUpdateReturningQuery(ctx context.Context, tableName, keyCol string, rows []map[string]interface{}, returning []string) (string, []interface{}, error) {
+	if len(returning) == 0 {
+		return "", nil, fmt.Errorf("no returning columns for table %s", tableName)
+	}
+	query, args, err := getBulkUpdateQuery(ctx, tableName, keyCol, rows, true)
+	if err != nil {
+		return "", nil, err
+	}
+	clause, err := returningClause(tableName, returning, ReturningExpr{Expr: `v."ordinal"`, Alias: "ordinal"})
+	if err != nil {
+		return "", nil, err
+	}
+	quoted := make([]string, len(returning))
+	for i, column := range returning {
+		quoted[i] = QuoteIdentifier(column)
+	}
+	return fmt.Sprintf(`WITH "updated" AS (%s%s) SELECT %s FROM "updated" ORDER BY "ordinal"`,
+		query, clause, strings.Join(quoted, ", ")), args, nil
+}
+
+// BulkUpdate executes GetBulkUpdateQuery and returns the number of updated rows
+func BulkUpdate(tableName, keyCol string, rows []map[string]interface{}) (int64, error) {
+	return BulkUpdateContext(context.Background(), tableName, keyCol, rows)
+}
+
+// BulkUpdateContext is BulkUpdate restricted to the tenant of ctx. Like the list helpers, it
+// fails with ErrNoTenant on a tenant-scoped table when ctx has no tenant.
+func BulkUpdateContext(ctx context.Context, tableName, keyCol string, rows []map[string]interface{}) (int64, error) {
+	query, args, err := getBulkUpdateQuery(ctx, tableName, keyCol, rows, false)
+	if err != nil {
+		return 0, err
+	}
+	result, err := ExecContext(WithQueryTable(ctx, tableName), query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetDeleteWhereQuery builds a DELETE for the rows matching filters. Empty filters are rejected
+// so a missing filter can't wipe the table. It is not tenant scoped; DeleteWhereContext is.
+func GetDeleteWhereQuery(tableName string, filters *Filter) (string, []interface{}, error) {
+	conditions, args, err := constructConditions(tableName, filters, tableName)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(conditions) == 0 {
+		return "", nil, fmt.Errorf("refusing to delete from %s without conditions", tableName)
+	}
+	return fmt.Sprintf(`DELETE FROM %s WHERE %s`, quoteTable(tableName), strings.Join(conditions, " AND ")), args, nil
+}
+
+// getDeleteWhereQuery is GetDeleteWhereQuery restricted to the tenant of ctx. The tenant
+// condition alone doesn't count as a filter, so it can't wipe a tenant's rows either.
+func getDeleteWhereQuery(ctx context.Context, tableName string, filters *Filter) (string, []interface{}, error) {
+	if _, _, err := GetDeleteWhereQuery(tableName, filters); err != nil {
+		return "", nil, err
+	}
+	scoped, err := scopeFilters(ctx, tableName, filters)
+	if err != nil {
+		return "", nil, err
+	}
+	return GetDeleteWhereQuery(tableName, scoped)
+}
+
+// DeleteWhere deletes the rows matching filters and returns the number of deleted rows
+func DeleteWhere(tableName string, filters *Filter) (int64, error) {
+	return DeleteWhereContext(context.Background(), tableName, filters)
+}
+
+// DeleteWhereContext is DeleteWhere restricted to the tenant of ctx. Like the list helpers, it
+// fails with ErrNoTenant on a tenant-scoped table when ctx has no tenant.
+func DeleteWhereContext(ctx context.Context, tableName string, filters *Filter) (int64, error) {
+	query, args, err := getDeleteWhereQuery(ctx, tableName, filters)
+	if err != nil {
+		return 0, err
+	}
+	result, err := ExecContext(WithQueryTable(ctx, tableName), query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// DeleteWhereReturning deletes the rows matching filters and scans their returning columns into dest, a pointer to a slice
+func DeleteWhereReturning(dest interface{}, tableName string, filters *Filter, returning ...string) error {
+	return DeleteWhereReturningContext(context.Background(), dest, tableName, filters, returning...)
+}
+
+// DeleteWhereReturningContext is DeleteWhereReturning restricted to the tenant of ctx
+func DeleteWhereReturningContext(ctx context.Context, dest interface{}, tableName string, filters *Filter, returning ...string) error {
+	query, args, err := getDeleteWhereQuery(ctx, tableName, filters)
+	if err != nil {
+		return err
+	}
+	clause, err := returningClause(tableName, returning)
+	if err != nil {
+		return err
+	}
+	return SelectContext(WithQueryTable(ctx, tableName), dest, query+clause, args...)
+}
+
+func returningClause(tableName string, columns []string, exprs ...ReturningExpr) (string, error) {
+	if len(columns) == 0 && len(exprs) == 0 {
+		return "", fmt.Errorf("no returning columns for table %s", tableName)
+	}
+	if err := validateReturning(tableName, columns...); err != nil {
+		return "", err
+	}
+
+	quotedTableName := quoteTable(tableName)
+	quoted := make([]string, 0, len(columns)+len(exprs))
+	for _, column := range columns {
+		quoted = append(quoted, quotedTableName+"."+QuoteIdentifier(column))
+	}
+	for _, expr := range exprs {
+		if expr.Alias == "" {
+			return "", fmt.Errorf("returning expression %s has no alias", expr.Expr)
+		}
+		quoted = append(quoted, expr.Expr+" AS "+QuoteIdentifier(expr.Alias))
+	}
+	return " RETURNING " + strings.Join(quoted, ", "), nil
+}
+
+// TruncateOptions adds RESTART IDENTITY and CASCADE to a TRUNCATE
+type TruncateOptions struct {
+	RestartIdentity bool
+	Cascade         bool
+}
+
+// Truncate empties the given registered tables in a single TRUNCATE
+func Truncate(tables ...string) error {
+	return TruncateWith(TruncateOptions{}, tables...)
+}
+
+// TruncateWith is Truncate with options. Tables must be registered with InitModelTagCache,
+// so a typo can't empty an arbitrary table.
+func TruncateWith(opts TruncateOptions, tables ...string) error {
+	query, err := getTruncateQuery(opts, tables...)
+	if err != nil {
+		return err
+	}
+	_, err = ExecContext(WithQueryTable(context.Background(), strings.Join(tables, ",")), query)
+	return err
+}
+
+func getTruncateQuery(opts TruncateOptions, tables ...string) (string, error) {
+	if len(tables) == 0 {
+		return "", fmt.Errorf("no tables to truncate")
+	}
+	quoted := make([]string, len(tables))
+	for i, table := range tables {
+		if _, ok := getModelInfo(table); !ok {
+			return "", fmt.Errorf("table name not initialized: %s", table)
+		}
+		quoted[i] = quoteTable(table)
+	}
+
+	query := "TRUNCATE TABLE " + strings.Join(quoted, ", ")
+	if opts.RestartIdentity {
+		query += " RESTART IDENTITY"
+	}
+	if opts.Cascade {
+		query += " CASCADE"
+	}
+	return query, nil
+}
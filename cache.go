@@ -11,9 +11,13 @@ import (
 
 var modelFieldsCache = nyxutils.NewSafeMap[*modelInfo]()
 
+// modelTables maps a model type (see typeKey) to its table name, for diagnostics
+var modelTables = nyxutils.NewSafeMap[string]()
+
 type modelInfo struct {
 	dbTagMap          map[string]string
 	dbInsertValueMap  map[string]string
+	dbUpdateValueMap  map[string]string // column -> SQL expression set by updates omitting it
 	dbFieldsSelect    []string
 	dbFieldsInsert    []string
 	dbFieldsUpdate    []string
@@ -21,6 +25,14 @@ type modelInfo struct {
 	dbFieldsInsertMap map[string]struct{}
 	dbFieldsUpdateMap map[string]struct{}
 	linkedFields      map[string]string // FieldName -> TableAlias
+	dbFieldTypes      map[string]reflect.Type
+	primaryKey        string
+	uuidFields        map[string]struct{} // generated on insert when omitted
+	defaultSort       Sort
+	tenantField       string // struct field of the dbMode:"tenant" column
+	indexedColumns    map[string]struct{}
+	dbCasts           map[string]string // column -> type from the dbCast tag
+	sortExprs         map[string]SortExpr
 }
 
 // InitModelTagCache initializes the model metadata cache
@@ -33,11 +45,17 @@ func InitModelTagCache(model interface{}, tableName string) {
 
 	dbTagMap := make(map[string]string)
 	dbInsertValueMap := make(map[string]string)
+	dbUpdateValueMap := make(map[string]string)
 	var dbFieldsSelect, dbFieldsInsert, dbFieldsUpdate []string
 	dbFieldsSelectMap := make(map[string]struct{})
 	dbFieldsInsertMap := make(map[string]struct{})
 	dbFieldsUpdateMap := make(map[string]struct{})
 	linkedFields := make(map[string]string)
+	dbFieldTypes := make(map[string]reflect.Type)
+	primaryKey := ""
+	tenantField := ""
+	uuidFields := make(map[string]struct{})
+	dbCasts := make(map[string]string)
 
 	for i := 0; i < modelType.NumField(); i++ {
 		field := modelType.Field(i)
@@ -62,12 +80,29 @@ func InitModelTagCache(model interface{}, tableName string) {
 		}
 
 		dbTagMap[field.Name] = dbTagValue
+		dbFieldTypes[dbTagValue] = field.Type
+		if dbCast := field.Tag.Get("dbCast"); dbCast != "" {
+			dbCasts[dbTagValue] = dbCast
+		}
 
 		if modeFlags["s"] {
 			continue
 		}
+		if dbUpdateValue := field.Tag.Get("dbUpdateValue"); dbUpdateValue != "" {
+			dbUpdateValueMap[dbTagValue] = dbUpdateValue
+		}
+
+		if modeFlags["pk"] {
+			primaryKey = dbTagValue
+		}
+		if modeFlags["uuid"] {
+			uuidFields[dbTagValue] = struct{}{}
+		}
+		if modeFlags["tenant"] {
+			tenantField = field.Name
+		}
 
-		if modeFlags["i"] {
+		if modeFlags["i"] || modeFlags["uuid"] {
 			dbFieldsInsert = append(dbFieldsInsert, dbTagValue)
 			dbFieldsInsertMap[dbTagValue] = struct{}{}
 			if dbInsertValue != "" {
@@ -85,6 +120,7 @@ func InitModelTagCache(model interface{}, tableName string) {
 	modelInfo := &modelInfo{
 		dbTagMap:          dbTagMap,
 		dbInsertValueMap:  dbInsertValueMap,
+		dbUpdateValueMap:  dbUpdateValueMap,
 		dbFieldsSelect:    dbFieldsSelect,
 		dbFieldsInsert:    dbFieldsInsert,
 		dbFieldsUpdate:    dbFieldsUpdate,
@@ -92,9 +128,135 @@ func InitModelTagCache(model interface{}, tableName string) {
 		dbFieldsInsertMap: dbFieldsInsertMap,
 		dbFieldsUpdateMap: dbFieldsUpdateMap,
 		linkedFields:      linkedFields,
+		dbFieldTypes:      dbFieldTypes,
+		primaryKey:        primaryKey,
+		uuidFields:        uuidFields,
+		tenantField:       tenantField,
+		dbCasts:           dbCasts,
 	}
 
 	modelFieldsCache.Set(tableName, modelInfo)
+	modelTables.Set(typeKey(modelType), tableName)
+}
+
+func typeKey(t reflect.Type) string {
+	return t.PkgPath() + "." + t.Name()
+}
+
+// ModelInfo is a read-only copy of the metadata InitModelTagCache derived from a model
+type ModelInfo struct {
+	Table        string
+	Fields       map[string]string // struct field name -> column
+	SelectFields []string
+	InsertFields []string
+	UpdateFields []string
+	InsertValues map[string]string // column -> dbInsertValue
+	UpdateValues map[string]string // column -> dbUpdateValue
+	LinkedFields map[string]string // struct field name -> table alias
+	PrimaryKey   string
+	UUIDFields   []string
+	TenantField  string
+	Casts        map[string]string // column -> dbCast type
+}
+
+// InitModelTagCacheReturn is InitModelTagCache returning a copy of the table's metadata.
+// When the table is already registered, the existing metadata is returned.
+func InitModelTagCacheReturn(model interface{}, tableName string) *ModelInfo {
+	InitModelTagCache(model, tableName)
+	modelInfo, _ := getModelInfo(tableName)
+
+	uuidFields := []string{}
+	for _, column := range modelInfo.dbFieldsInsert {
+		if _, ok := modelInfo.uuidFields[column]; ok {
+			uuidFields = append(uuidFields, column)
+		}
+	}
+	return &ModelInfo{
+		Table:        tableName,
+		Fields:       copyStringMap(modelInfo.dbTagMap),
+		SelectFields: append([]string{}, modelInfo.dbFieldsSelect...),
+		InsertFields: append([]string{}, modelInfo.dbFieldsInsert...),
+		UpdateFields: append([]string{}, modelInfo.dbFieldsUpdate...),
+		InsertValues: copyStringMap(modelInfo.dbInsertValueMap),
+		UpdateValues: copyStringMap(modelInfo.dbUpdateValueMap),
+		LinkedFields: copyStringMap(modelInfo.linkedFields),
+		PrimaryKey:   modelInfo.primaryKey,
+		UUIDFields:   uuidFields,
+		TenantField:  modelInfo.tenantField,
+		Casts:        copyStringMap(modelInfo.dbCasts),
+	}
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	copied := make(map[string]string, len(m))
+	for k, v := range m {
+		copied[k] = v
+	}
+	return copied
+}
+
+// SetDefaultSort registers the sort applied by List when the caller passes none
+func SetDefaultSort(tableName string, sort Sort) {
+	modelInfo, ok := getModelInfo(tableName)
+	if !ok {
+		panic("table name not initialized: " + tableName)
+	}
+	modelInfo.defaultSort = sort
+}
+
+// SetIndexedColumns registers the indexed columns of a table, checked by StrictSort.
+// The primary key always counts as indexed.
+func SetIndexedColumns(tableName string, columns ...string) {
+	modelInfo, ok := getModelInfo(tableName)
+	if !ok {
+		panic("table name not initialized: " + tableName)
+	}
+	indexed := make(map[string]struct{}, len(columns))
+	for _, column := range columns {
+		if _, ok := modelInfo.dbFieldsSelectMap[column]; !ok {
+			panic(fmt.Sprintf("unknown column %s for table %s", column, tableName))
+		}
+		indexed[column] = struct{}{}
+	}
+	modelInfo.indexedColumns = indexed
+}
+
+// SetSortExpr registers a computed sort key that Sort can then reference by name,
+// e.g. SetSortExpr("realm", "Touched", SortGreatest("CreatedAt", "UpdatedAt")).
+func SetSortExpr(tableName, name string, expr SortExpr) {
+	modelInfo, ok := getModelInfo(tableName)
+	if !ok {
+		panic("table name not initialized: " + tableName)
+	}
+	if _, ok := modelInfo.dbTagMap[name]; ok {
+		panic(fmt.Sprintf("sort expression %s shadows a field of table %s", name, tableName))
+	}
+	if !reSortFunc.MatchString(expr.Func) || len(expr.Fields) == 0 {
+		panic(fmt.Sprintf("invalid sort expression %s for table %s", name, tableName))
+	}
+	for _, field := range expr.Fields {
+		if _, ok := modelInfo.dbTagMap[field]; !ok {
+			panic(fmt.Sprintf("unknown field %s for table %s", field, tableName))
+		}
+	}
+	if modelInfo.sortExprs == nil {
+		modelInfo.sortExprs = map[string]SortExpr{}
+	}
+	modelInfo.sortExprs[name] = expr
+}
+
+// validateReturning checks that every returning column is a select field of the table
+func validateReturning(tableName string, columns ...string) error {
+	modelInfo, ok := getModelInfo(tableName)
+	if !ok {
+		return fmt.Errorf("table name not initialized: %s", tableName)
+	}
+	for _, column := range columns {
+		if _, ok := modelInfo.dbFieldsSelectMap[column]; !ok {
+			return fmt.Errorf("invalid returning column %s for table %s", column, tableName)
+		}
+	}
+	return nil
 }
 
 func getModelInfo(tableName string) (*modelInfo, bool) {
@@ -118,9 +280,18 @@ func getModelType(model interface{}) reflect.Type {
 }
 
 func getFieldsByMode(tableName, mode, aliasTableName string) ([]string, []string) {
+	fields, fieldNames, err := getFieldsByModeE(tableName, mode, aliasTableName, ".")
+	if err != nil {
+		panic(err.Error())
+	}
+	return fields, fieldNames
+}
+
+// getFieldsByModeE qualifies aliased columns as "alias<aliasSep>column" in the select list
+func getFieldsByModeE(tableName, mode, aliasTableName, aliasSep string) ([]string, []string, error) {
 	modelInfo, ok := getModelInfo(tableName)
 	if !ok {
-		panic("table name not initialized: " + tableName)
+		return nil, nil, fmt.Errorf("table name not initialized: %s", tableName)
 	}
 
 	var fields []string
@@ -135,22 +306,21 @@ func getFieldsByMode(tableName, mode, aliasTableName string) ([]string, []string
 	case "update":
 		dbFields = modelInfo.dbFieldsUpdate
 	default:
-		panic("invalid mode")
+		return nil, nil, fmt.Errorf("invalid mode: %s", mode)
 	}
 
 	for _, fieldName := range dbFields {
-		quotedTableName := `"` + strings.ReplaceAll(tableName, `"`, ``) + `"`
-		quotedFieldName := `"` + strings.ReplaceAll(fieldName, `"`, ``) + `"`
+		quotedTableName := quoteTable(tableName)
+		quotedFieldName := QuoteIdentifier(fieldName)
 		if aliasTableName != "" {
-			aliasTableName = strings.ReplaceAll(aliasTableName, `"`, "")
-			fields = append(fields, `"`+aliasTableName+`".`+quotedFieldName+` AS "`+aliasTableName+`.`+fieldName+`"`)
+			fields = append(fields, QuoteIdentifier(aliasTableName)+`.`+quotedFieldName+` AS `+QuoteIdentifier(aliasTableName+aliasSep+fieldName))
 		} else {
 			fields = append(fields, quotedTableName+"."+quotedFieldName)
 		}
 		fieldNames = append(fieldNames, fieldName)
 	}
 
-	return fields, fieldNames
+	return fields, fieldNames, nil
 }
 
 // Public API functions
@@ -158,6 +328,18 @@ func GetSelectFields(tableName, aliasTableName string) ([]string, []string) {
 	return getFieldsByMode(tableName, "select", aliasTableName)
 }
 
+// GetSelectFieldsFlat is GetSelectFields with underscore-flattened aliases ("alias_column")
+// for scanning joined columns into flat structs instead of nested ones.
+func GetSelectFieldsFlat(tableName, aliasTableName string) ([]string, []string) {
+	fields, fieldNames, err := getFieldsByModeE(tableName, "select", aliasTableName, "_")
+	if err != nil {
+		panic(err.Error())
+	}
+	return fields, fieldNames
+}
+
+// GetInsertFields returns the insert columns in struct field declaration order,
+// which is the column order of every generated INSERT.
 func GetInsertFields(tableName string) ([]string, []string) {
 	return getFieldsByMode(tableName, "insert", "")
 }
@@ -0,0 +1,81 @@
+// cursor.go
+package fsql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DeclareCursor declares a server-side cursor for query within tx.
+// The cursor lives until CloseCursor or the end of the transaction.
+func DeclareCursor(tx *sqlx.Tx, name, query string, args ...interface{}) error {
+	return execCursor(context.Background(), tx, fmt.Sprintf(`DECLARE %s NO SCROLL CURSOR FOR %s`, quoteCursorName(name), query), args...)
+}
+
+// FetchCursor fetches the next n rows from the cursor. An empty result means the cursor is exhausted.
+func FetchCursor[T any](tx *sqlx.Tx, name string, n int) ([]T, error) {
+	rows := []T{}
+	if err := fetchCursor(context.Background(), tx, name, n, &rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// fetchCursor runs the FETCH through the query log like the Db helpers
+func fetchCursor(ctx context.Context, tx *sqlx.Tx, name string, n int, dest interface{}) (err error) {
+	query := fmt.Sprintf(`FETCH FORWARD %d FROM %s`, n, quoteCursorName(name))
+	defer func(start time.Time) { logQuery(ctx, query, nil, start, resultRows(dest, err), err) }(time.Now())
+	return enrichScanError(dest, tx.SelectContext(ctx, dest, query))
+}
+
+// IterateCursor fetches the cursor in batches of n and calls fn for each row until the
+// cursor is exhausted. It stops with ctx.Err() as soon as ctx is cancelled. The cursor is
+// closed when IterateCursor returns, so it doesn't hold its resources until the end of tx.
+func IterateCursor[T any](ctx context.Context, tx *sqlx.Tx, name string, n int, fn func(*T) error) (err error) {
+	defer func() {
+		// A failed or cancelled iteration keeps its own error, the transaction may be aborted
+		if closeErr := CloseCursor(tx, name); err == nil {
+			err = closeErr
+		}
+	}()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rows := []T{}
+		if err := fetchCursor(ctx, tx, name, n, &rows); err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		for i := range rows {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if err := fn(&rows[i]); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// CloseCursor closes the cursor and releases its resources
+func CloseCursor(tx *sqlx.Tx, name string) error {
+	return execCursor(context.Background(), tx, fmt.Sprintf(`CLOSE %s`, quoteCursorName(name)))
+}
+
+// execCursor runs a cursor statement through the query log like fetchCursor
+func execCursor(ctx context.Context, tx *sqlx.Tx, query string, args ...interface{}) (err error) {
+	defer func(start time.Time) { logQuery(ctx, query, args, start, -1, err) }(time.Now())
+	_, err = tx.ExecContext(ctx, query, args...)
+	return err
+}
+
+func quoteCursorName(name string) string {
+	return QuoteIdentifier(name)
+}
@@ -0,0 +1,104 @@
+// diff.go
+package fsql
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Diff compares two instances of a model and returns the db columns whose value changed,
+// mapped to their value in new. The result can be passed as the valuesMap of GetUpdateQuery
+// once the key column is added. Valuers such as the Null* types are compared by their
+// driver value, so two invalid values are equal whatever they hold, and pointers by the
+// value they point to. Only updatable columns are compared: the dbMode:"u" columns when T is
+// registered with InitModelTagCache, otherwise every column but the link and select-only ones.
+func Diff[T any](old, new *T) map[string]interface{} {
+	changes := map[string]interface{}{}
+	oldValue := reflect.ValueOf(old).Elem()
+	newValue := reflect.ValueOf(new).Elem()
+	if oldValue.Kind() != reflect.Struct {
+		panic("Diff expects a pointer to a struct")
+	}
+
+	var updatable map[string]struct{}
+	if tableName, ok := modelTables.Get(typeKey(oldValue.Type())); ok {
+		if modelInfo, ok := getModelInfo(tableName); ok {
+			updatable = modelInfo.dbFieldsUpdateMap
+		}
+	}
+
+	for i := 0; i < oldValue.NumField(); i++ {
+		field := oldValue.Type().Field(i)
+		dbTagValue := field.Tag.Get("db")
+		if dbTagValue == "" || dbTagValue == "-" || !field.IsExported() {
+			continue
+		}
+		if updatable != nil {
+			if _, ok := updatable[dbTagValue]; !ok {
+				continue
+			}
+		} else if diffSkipMode(field.Tag.Get("dbMode")) {
+			continue
+		}
+		if !diffEqual(oldValue.Field(i), newValue.Field(i)) {
+			changes[dbTagValue] = newValue.Field(i).Interface()
+		}
+	}
+	return changes
+}
+
+// diffSkipMode reports whether the dbMode of an unregistered field marks it link or select-only
+func diffSkipMode(dbMode string) bool {
+	for _, mode := range strings.Split(dbMode, ",") {
+		if mode == "l" || mode == "link" || mode == "s" {
+			return true
+		}
+	}
+	return false
+}
+
+// diffEqual compares two field values through their driver value when they have one
+func diffEqual(a, b reflect.Value) bool {
+	a, aNil := diffDeref(a)
+	b, bNil := diffDeref(b)
+	if aNil || bNil {
+		return aNil == bNil
+	}
+
+	aValue, aErr := diffDriverValue(a)
+	bValue, bErr := diffDriverValue(b)
+	if aErr != nil || bErr != nil {
+		return reflect.DeepEqual(a.Interface(), b.Interface())
+	}
+	if aTime, ok := aValue.(time.Time); ok {
+		bTime, ok := bValue.(time.Time)
+		return ok && aTime.Equal(bTime)
+	}
+	return reflect.DeepEqual(aValue, bValue)
+}
+
+// diffDeref follows pointers, reporting whether a nil one was met
+func diffDeref(v reflect.Value) (reflect.Value, bool) {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return v, true
+		}
+		v = v.Elem()
+	}
+	return v, false
+}
+
+// diffDriverValue returns the driver value of a Valuer, or the plain value
+func diffDriverValue(v reflect.Value) (interface{}, error) {
+	if valuer, ok := v.Interface().(driver.Valuer); ok {
+		return valuer.Value()
+	}
+	if v.CanAddr() {
+		if valuer, ok := v.Addr().Interface().(driver.Valuer); ok {
+			return valuer.Value()
+		}
+	}
+	return v.Interface(), nil
+}
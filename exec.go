@@ -0,0 +1,105 @@
+// exec.go
+package fsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultQueryTimeout bounds every query issued through fsql whose context has no deadline.
+// A caller-supplied deadline always wins. Zero disables the default.
+var DefaultQueryTimeout time.Duration
+
+func withDefaultTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if DefaultQueryTimeout <= 0 {
+		return ctx, func() {}
+	}
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, DefaultQueryTimeout)
+}
+
+// ExecContext executes a statement on Db
+func ExecContext(ctx context.Context, query string, args ...interface{}) (result sql.Result, err error) {
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	defer func(start time.Time) { logQuery(ctx, query, args, start, affectedRows(result, err), err) }(time.Now())
+	return Db.ExecContext(ctx, query, args...)
+}
+
+// GetContext scans a single row into dest, returning sql.ErrNoRows when nothing matches
+func GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) (err error) {
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	defer func(start time.Time) { logQuery(ctx, query, args, start, resultRows(dest, err), err) }(time.Now())
+	return enrichScanError(dest, Db.GetContext(ctx, dest, query, args...))
+}
+
+// SelectContext scans all rows into dest, a pointer to a slice
+func SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) (err error) {
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	defer func(start time.Time) { logQuery(ctx, query, args, start, resultRows(dest, err), err) }(time.Now())
+	return enrichScanError(dest, Db.SelectContext(ctx, dest, query, args...))
+}
+
+// NamedExec executes a statement with :name parameters bound from arg, a struct with db tags or a map
+func NamedExec(query string, arg interface{}) (sql.Result, error) {
+	return NamedExecContext(context.Background(), query, arg)
+}
+
+// NamedExecContext is NamedExec with a context
+func NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error) {
+	query, args, err := Db.BindNamed(query, arg)
+	if err != nil {
+		return nil, err
+	}
+	return ExecContext(ctx, query, args...)
+}
+
+// NamedGet runs a single-row query with :name parameters bound from arg and scans it into a new T.
+// It returns (nil, nil) when the query matches no rows, like GetStruct.
+func NamedGet[T any](query string, arg interface{}) (*T, error) {
+	return NamedGetContext[T](context.Background(), query, arg)
+}
+
+// NamedGetContext is NamedGet with a context
+func NamedGetContext[T any](ctx context.Context, query string, arg interface{}) (*T, error) {
+	query, args, err := Db.BindNamed(query, arg)
+	if err != nil {
+		return nil, err
+	}
+	return GetStructContext[T](ctx, query, args...)
+}
+
+var reMissingDestination = regexp.MustCompile(`missing destination name (\S+)`)
+
+// enrichScanError turns sqlx's "missing destination name" error into one naming the column,
+// the destination type and the columns its registered model maps.
+func enrichScanError(dest interface{}, err error) error {
+	if err == nil {
+		return nil
+	}
+	match := reMissingDestination.FindStringSubmatch(err.Error())
+	if match == nil {
+		return err
+	}
+
+	t := reflect.TypeOf(dest)
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	tableName, ok := modelTables.Get(typeKey(t))
+	if !ok {
+		return fmt.Errorf("column %s returned by the query has no db field in %s: %w", match[1], t, err)
+	}
+	modelInfo, _ := getModelInfo(tableName)
+	return fmt.Errorf("column %s returned by the query has no db field in %s (table %s maps %s): %w",
+		match[1], t, tableName, strings.Join(modelInfo.dbFieldsSelect, ", "), err)
+}
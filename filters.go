@@ -2,17 +2,128 @@
 package fsql
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
+	"net/url"
+	"reflect"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/lib/pq"
+	"github.com/soulkyn-ai/nyxutils"
 )
 
+// Filter maps "Field" or "Field[$op]" keys to values; conditions are AND-joined.
+// Being a map, a key can only appear once: for two conditions on one field use distinct
+// operators ("CreatedAt[$gte]" and "CreatedAt[$lte]"), "$between" with a two-element slice,
+// or a FilterGroup with a nested group per condition.
 type Filter map[string]interface{}
 type Sort map[string]string
 
+// SortExpr is a computed sort key rendered as Func(field columns...), registered with SetSortExpr
+type SortExpr struct {
+	Func   string
+	Fields []string
+}
+
+var reSortFunc = regexp.MustCompile(`^[A-Za-z_]+$`)
+
+// SortGreatest sorts by the greatest of the fields, e.g. the most recent of two timestamps
+func SortGreatest(fields ...string) SortExpr {
+	return SortExpr{Func: "GREATEST", Fields: fields}
+}
+
+// SortLeast sorts by the least of the fields
+func SortLeast(fields ...string) SortExpr {
+	return SortExpr{Func: "LEAST", Fields: fields}
+}
+
+// SortCoalesce sorts by the first non-NULL field
+func SortCoalesce(fields ...string) SortExpr {
+	return SortExpr{Func: "COALESCE", Fields: fields}
+}
+
+func (se SortExpr) sql(t string, modelInfo *modelInfo) string {
+	columns := make([]string, len(se.Fields))
+	for i, field := range se.Fields {
+		columns[i] = quoteTable(t) + "." + QuoteIdentifier(modelInfo.dbTagMap[field])
+	}
+	return se.Func + "(" + strings.Join(columns, ", ") + ")"
+}
+
+// Subquery is a filter value matching the field against the rows of a subquery,
+// e.g. Filter{"UUID": Subquery{...}} renders "t"."uuid" IN (...), and "UUID[$nin]" NOT IN.
+// Its $n placeholders are numbered from $1 and shifted after the preceding filter args.
+type Subquery struct {
+	Query string
+	Args  []interface{}
+}
+
+// FilterGroup combines a filter map and nested groups with AND (or OR when Or is set).
+// Negate wraps the rendered group in NOT (...).
+type FilterGroup struct {
+	Filter Filter
+	Groups []FilterGroup
+	Or     bool
+	Negate bool
+}
+
+// OperatorFunc renders a custom filter operator for the quoted table and column. The condition uses
+// $argIndex onwards for its arguments and consumesArgs tells how many: 0 ignores the filter value,
+// 1 binds it as is, more expects a slice of exactly that many values.
+type OperatorFunc func(table, column string, argIndex int) (condition string, consumesArgs int)
+
+var customOperators = nyxutils.NewSafeMap[OperatorFunc]()
+
+var builtinOperators = map[string]struct{}{
+	"": {}, "$eq": {}, "€eq": {}, "$ne": {}, "$gt": {}, "$gte": {}, "$lt": {}, "$lte": {},
+	"$prefix": {}, "€prefix": {}, "$suffix": {}, "€suffix": {}, "$like": {}, "€like": {},
+	"$in": {}, "$nin": {}, "$arraycontains": {}, "$between": {}, "$arraylen": {},
+}
+
+// arrayLenComparisons are the comparisons accepted after "$arraylen:", e.g. "Tags[$arraylen:$gt]"
+var arrayLenComparisons = map[string]struct{}{
+	"$eq": {}, "$ne": {}, "$gt": {}, "$gte": {}, "$lt": {}, "$lte": {},
+}
+
+func isBuiltinOperator(operator string) bool {
+	if _, ok := builtinOperators[operator]; ok {
+		return true
+	}
+	return strings.HasPrefix(operator, "$arraylen:")
+}
+
+// RegisterOperator adds a custom filter operator usable as "Field[name]".
+// Registering a built-in or already registered name is an error.
+func RegisterOperator(name string, fn OperatorFunc) error {
+	if isBuiltinOperator(name) {
+		return fmt.Errorf("operator %s is built in", name)
+	}
+	if _, ok := customOperators.Get(name); ok {
+		return fmt.Errorf("operator %s is already registered", name)
+	}
+	customOperators.Set(name, fn)
+	return nil
+}
+
+// allowedFilterCasts whitelists the "Field::type" casts accepted in filter keys
+var allowedFilterCasts = map[string]struct{}{
+	"int":         {},
+	"numeric":     {},
+	"timestamptz": {},
+	"boolean":     {},
+}
+
 func constructConditions(t string, filters *Filter, table string) ([]string, []interface{}, error) {
+	return constructConditionsFrom(t, filters, table, 1)
+}
+
+func constructConditionsFrom(t string, filters *Filter, table string, argCounter int) ([]string, []interface{}, error) {
 	modelInfo, ok := getModelInfo(table)
 	if !ok {
 		return nil, nil, fmt.Errorf("table name not initialized: %s", table)
@@ -20,10 +131,17 @@ func constructConditions(t string, filters *Filter, table string) ([]string, []i
 
 	var conditions []string
 	var args []interface{}
-	argCounter := 1
 
 	if filters != nil {
-		for filterKey, filterValue := range *filters {
+		// Conditions are emitted in key order so equal filters always produce the same SQL
+		filterKeys := make([]string, 0, len(*filters))
+		for filterKey := range *filters {
+			filterKeys = append(filterKeys, filterKey)
+		}
+		sort.Strings(filterKeys)
+
+		for _, filterKey := range filterKeys {
+			filterValue := (*filters)[filterKey]
 			fieldParts := strings.Split(filterKey, "[")
 			fieldName := fieldParts[0]
 			operator := ""
@@ -31,27 +149,100 @@ func constructConditions(t string, filters *Filter, table string) ([]string, []i
 				operator = strings.TrimSuffix(fieldParts[1], "]")
 			}
 
+			cast := ""
+			if i := strings.Index(fieldName, "::"); i >= 0 {
+				fieldName, cast = fieldName[:i], fieldName[i+2:]
+				if _, ok := allowedFilterCasts[cast]; !ok {
+					return nil, nil, fmt.Errorf("cast to %s is not allowed in filter %s", cast, filterKey)
+				}
+			}
+
 			dbField, exists := modelInfo.dbTagMap[fieldName]
 			if !exists {
 				continue
 			}
 
+			column := quoteTable(t) + "." + QuoteIdentifier(dbField)
+			if cast != "" {
+				column = fmt.Sprintf(`(%s)::%s`, column, cast)
+			}
+
+			// $arraylen compares the array length, counting empty arrays as 0 rather than NULL
+			if operator == "$arraylen" || strings.HasPrefix(operator, "$arraylen:") {
+				comparison := strings.TrimPrefix(strings.TrimPrefix(operator, "$arraylen"), ":")
+				if _, ok := arrayLenComparisons[comparison]; comparison != "" && !ok {
+					return nil, nil, fmt.Errorf("invalid $arraylen comparison %s in filter %s", comparison, filterKey)
+				}
+				column = fmt.Sprintf(`COALESCE(array_length(%s, 1), 0)`, column)
+				operator = comparison
+			}
+
+			if subquery, ok := filterValue.(Subquery); ok {
+				keyword := "IN"
+				if operator == "$nin" {
+					keyword = "NOT IN"
+				}
+				conditions = append(conditions, fmt.Sprintf(`%s %s (%s)`, column, keyword, shiftPlaceholders(subquery.Query, argCounter-1)))
+				args = append(args, subquery.Args...)
+				argCounter += len(subquery.Args)
+				continue
+			}
+
+			if operator == "$between" {
+				bounds := reflect.ValueOf(filterValue)
+				if (bounds.Kind() != reflect.Slice && bounds.Kind() != reflect.Array) || bounds.Len() != 2 {
+					return nil, nil, fmt.Errorf("$between on %s expects two values", fieldName)
+				}
+				conditions = append(conditions, fmt.Sprintf(`%s BETWEEN $%d AND $%d`, column, argCounter, argCounter+1))
+				args = append(args, bounds.Index(0).Interface(), bounds.Index(1).Interface())
+				argCounter += 2
+				continue
+			}
+
+			if !isBuiltinOperator(operator) {
+				if fn, ok := customOperators.Get(operator); ok {
+					condition, consumed := fn(quoteTable(t), QuoteIdentifier(dbField), argCounter)
+					switch {
+					case consumed == 1:
+						args = append(args, filterValue)
+					case consumed > 1:
+						values := reflect.ValueOf(filterValue)
+						if values.Kind() != reflect.Slice || values.Len() != consumed {
+							return nil, nil, fmt.Errorf("%s on %s expects %d values", operator, fieldName, consumed)
+						}
+						for i := 0; i < consumed; i++ {
+							args = append(args, values.Index(i).Interface())
+						}
+					}
+					conditions = append(conditions, condition)
+					argCounter += consumed
+					continue
+				}
+			}
+
 			conditionStr := getConditionString(operator)
-			isArray := operator == "$in" || operator == "$nin"
+			isArray := operator == "$in" || operator == "$nin" || operator == "$arraycontains"
 
 			shouldLower := strings.HasPrefix(operator, "€")
 			if shouldLower {
-				condition := fmt.Sprintf(`LOWER("%s".%s) %s`, t, dbField, conditionStr)
+				condition := fmt.Sprintf(`LOWER(%s) %s`, column, conditionStr)
 				conditions = append(conditions, fmt.Sprintf(condition, argCounter))
 				if strVal, ok := filterValue.(string); ok {
 					filterValue = strings.ToLower(strVal)
 				}
 			} else {
-				condition := fmt.Sprintf(`"%s".%s %s`, t, dbField, conditionStr)
+				condition := fmt.Sprintf(`%s %s`, column, conditionStr)
 				conditions = append(conditions, fmt.Sprintf(condition, argCounter))
 			}
 
-			if isArray {
+			if _, isValuer := filterValue.(driver.Valuer); isArray && !isValuer {
+				values, err := valuerSliceValues(filterValue)
+				if err != nil {
+					return nil, nil, fmt.Errorf("filter %s: %w", filterKey, err)
+				}
+				if values != nil {
+					filterValue = values
+				}
 				filterValue = pq.Array(filterValue)
 			}
 
@@ -63,6 +254,64 @@ func constructConditions(t string, filters *Filter, table string) ([]string, []i
 	return conditions, args, nil
 }
 
+// valuerSliceValues converts a slice of driver.Valuer elements, which pq.Array can't encode,
+// to their driver values, with times formatted for PostgreSQL. It returns nil for other values.
+func valuerSliceValues(value interface{}) ([]interface{}, error) {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice || !v.Type().Elem().Implements(reflect.TypeOf((*driver.Valuer)(nil)).Elem()) {
+		return nil, nil
+	}
+
+	values := make([]interface{}, v.Len())
+	for i := range values {
+		element := v.Index(i)
+		if element.Kind() == reflect.Ptr && element.IsNil() {
+			continue
+		}
+		driverValue, err := element.Interface().(driver.Valuer).Value()
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := driverValue.(time.Time); ok {
+			driverValue = t.Format(time.RFC3339Nano)
+		}
+		values[i] = driverValue
+	}
+	return values, nil
+}
+
+func constructGroupCondition(t string, group *FilterGroup, table string, argCounter int) (string, []interface{}, error) {
+	conditions, args, err := constructConditionsFrom(t, &group.Filter, table, argCounter)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for i := range group.Groups {
+		condition, groupArgs, err := constructGroupCondition(t, &group.Groups[i], table, argCounter+len(args))
+		if err != nil {
+			return "", nil, err
+		}
+		if condition != "" {
+			conditions = append(conditions, condition)
+			args = append(args, groupArgs...)
+		}
+	}
+
+	if len(conditions) == 0 {
+		return "", nil, nil
+	}
+
+	joiner := " AND "
+	if group.Or {
+		joiner = " OR "
+	}
+	condition := "(" + strings.Join(conditions, joiner) + ")"
+	if group.Negate {
+		condition = "NOT " + condition
+	}
+	return condition, args, nil
+}
+
 func getConditionString(operator string) string {
 	switch operator {
 	case "$prefix", "€prefix":
@@ -85,6 +334,8 @@ func getConditionString(operator string) string {
 		return `= ANY($%d)`
 	case "$nin":
 		return `!= ALL($%d)`
+	case "$arraycontains":
+		return `@> $%d`
 	case "$eq", "€eq":
 		return `= $%d`
 	default:
@@ -92,73 +343,650 @@ func getConditionString(operator string) string {
 	}
 }
 
+// FilterQueryPlan holds the clauses FilterQuery appends to a base query, before concatenation
+type FilterQueryPlan struct {
+	Conditions []string
+	Args       []interface{}
+	OrderBy    []string
+	Limit      int
+	Offset     int
+
+	// WithTies paginates with FETCH FIRST Limit ROWS WITH TIES, returning every row tied
+	// with the last one on the ORDER BY, instead of LIMIT
+	WithTies bool
+}
+
+// PlanFilterQuery builds the FilterQueryPlan for FilterQuery's arguments
+func PlanFilterQuery(t string, filters *Filter, sort *Sort, table string, perPage int, page int) (*FilterQueryPlan, error) {
+	return planFilterQuery(t, filters, sort, table, perPage, page, 1)
+}
+
+func planFilterQuery(t string, filters *Filter, sort *Sort, table string, perPage int, page int, argStart int) (*FilterQueryPlan, error) {
+	conditions, args, err := constructConditionsFrom(t, filters, table, argStart)
+	if err != nil {
+		return nil, err
+	}
+
+	orderBy, err := buildOrderBy(t, sort, table)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FilterQueryPlan{
+		Conditions: conditions,
+		Args:       args,
+		OrderBy:    orderBy,
+		Limit:      perPage,
+		Offset:     (page - 1) * perPage,
+	}, nil
+}
+
+// SQL appends the plan's clauses to baseQuery. A Limit <= 0 adds no LIMIT/OFFSET.
+func (p *FilterQueryPlan) SQL(baseQuery string) string {
+	if len(p.Conditions) > 0 {
+		baseQuery += " WHERE " + strings.Join(p.Conditions, " AND ")
+	}
+	if len(p.OrderBy) > 0 {
+		baseQuery += " ORDER BY " + strings.Join(p.OrderBy, ", ")
+	}
+	if p.Limit > 0 && p.WithTies {
+		baseQuery += fmt.Sprintf(" OFFSET %d ROWS FETCH FIRST %d ROWS WITH TIES", p.Offset, p.Limit)
+	} else if p.Limit > 0 {
+		baseQuery += fmt.Sprintf(" LIMIT %d OFFSET %d", p.Limit, p.Offset)
+	}
+	return baseQuery
+}
+
+// FilterQueryWithTies is FilterQuery returning, beyond the perPage rows, every row tied with
+// the last one on the sort, e.g. for leaderboards. It requires a sort.
+func FilterQueryWithTies(baseQuery string, t string, filters *Filter, sort *Sort, table string, perPage int, page int) (string, []interface{}, error) {
+	plan, err := PlanFilterQuery(t, filters, sort, table, perPage, page)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(plan.OrderBy) == 0 {
+		return "", nil, fmt.Errorf("WITH TIES requires a sort")
+	}
+	plan.WithTies = true
+	return plan.SQL(baseQuery), plan.Args, nil
+}
+
+// FilterQuery appends the filter conditions, sort and pagination to baseQuery.
+// A perPage <= 0 returns every matching row, without LIMIT/OFFSET.
 func FilterQuery(baseQuery string, t string, filters *Filter, sort *Sort, table string, perPage int, page int) (string, []interface{}, error) {
-	conditions, args, err := constructConditions(t, filters, table)
+	plan, err := PlanFilterQuery(t, filters, sort, table, perPage, page)
 	if err != nil {
 		return "", nil, err
 	}
+	return plan.SQL(baseQuery), plan.Args, nil
+}
 
-	if len(conditions) > 0 {
-		baseQuery += " WHERE " + strings.Join(conditions, " AND ")
+// DateRange filters field on the whole days from..to, both inclusive, using half-open bounds:
+// field >= start of from's day AND field < start of the day after to.
+// Merge it into other filters with Filter.Merge.
+func DateRange(field string, from, to time.Time) Filter {
+	start := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location())
+	end := time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, to.Location()).AddDate(0, 0, 1)
+	return Filter{
+		field + "[$gte]": start,
+		field + "[$lt]":  end,
 	}
+}
 
-	if sort != nil && len(*sort) > 0 {
-		sortClauses := []string{}
-		modelInfo, _ := getModelInfo(table)
+// Merge returns a copy of the filter with the entries of others added, later ones winning
+func (f Filter) Merge(others ...Filter) Filter {
+	merged := Filter{}
+	for key, value := range f {
+		merged[key] = value
+	}
+	for _, other := range others {
+		for key, value := range other {
+			merged[key] = value
+		}
+	}
+	return merged
+}
 
-		for field, order := range *sort {
-			order = strings.ToUpper(order)
-			if order != "ASC" && order != "DESC" {
-				return "", nil, fmt.Errorf("invalid sort order: %s", order)
-			}
-			dbField, exists := modelInfo.dbTagMap[field]
-			if exists {
-				sortClauses = append(sortClauses, fmt.Sprintf(`"%s".%s %s`, t, dbField, order))
-			}
+// FiltersFromStruct builds a Filter on table from a struct whose fields are tagged
+// `filter:"Field,$op"`, Field being the model field name as used in Filter keys and the
+// operator optional. Zero and empty fields are skipped; use a pointer field to filter on a
+// zero value. Fields without a filter tag are ignored, while a Field that isn't a column of
+// table or an unknown operator is an error, rather than a filter silently dropped.
+func FiltersFromStruct(v interface{}, table string) (*Filter, error) {
+	modelInfo, ok := getModelInfo(table)
+	if !ok {
+		return nil, fmt.Errorf("table name not initialized: %s", table)
+	}
+	value := reflect.ValueOf(v)
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return &Filter{}, nil
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("expected a struct, got %s", value.Kind())
+	}
+
+	filters := Filter{}
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		tag := field.Tag.Get("filter")
+		if tag == "" || tag == "-" || !field.IsExported() {
+			continue
+		}
+		name, operator, _ := strings.Cut(tag, ",")
+		if name == "" {
+			return nil, fmt.Errorf("invalid filter tag %q on %s", tag, field.Name)
+		}
+		column, _, _ := strings.Cut(name, "::")
+		if _, ok := modelInfo.dbTagMap[column]; !ok {
+			return nil, fmt.Errorf("unknown filter field %s on %s for table %s", column, field.Name, table)
+		}
+		if _, custom := customOperators.Get(operator); !isBuiltinOperator(operator) && !custom {
+			return nil, fmt.Errorf("unknown filter operator %s on %s", operator, field.Name)
+		}
+
+		fieldValue := value.Field(i)
+		if fieldValue.IsZero() || isEmptyFilterValue(fieldValue.Interface()) {
+			continue
+		}
+		if fieldValue.Kind() == reflect.Ptr {
+			fieldValue = fieldValue.Elem()
 		}
 
-		if len(sortClauses) > 0 {
-			baseQuery += " ORDER BY " + strings.Join(sortClauses, ", ")
+		key := name
+		if operator != "" {
+			key += "[" + operator + "]"
 		}
+		filters[key] = fieldValue.Interface()
 	}
+	return &filters, nil
+}
 
-	limit := perPage
-	offset := (page - 1) * perPage
-	baseQuery += fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
+// FilterQueryNonEmpty is FilterQuery ignoring the filter entries with an empty value
+// (nil, "" or an empty slice), so absent optional parameters don't filter anything.
+func FilterQueryNonEmpty(baseQuery string, t string, filters *Filter, sort *Sort, table string, perPage int, page int) (string, []interface{}, error) {
+	return FilterQuery(baseQuery, t, filters.NonEmpty(), sort, table, perPage, page)
+}
 
-	return baseQuery, args, nil
+// NonEmpty returns a copy of the filter without the entries whose value is nil, "" or an empty slice
+func (f *Filter) NonEmpty() *Filter {
+	if f == nil {
+		return nil
+	}
+	filtered := Filter{}
+	for key, value := range *f {
+		if !isEmptyFilterValue(value) {
+			filtered[key] = value
+		}
+	}
+	return &filtered
+}
+
+func isEmptyFilterValue(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+// FilterGroupQuery is FilterQuery for a structured FilterGroup (OR, nesting and negation)
+func FilterGroupQuery(baseQuery string, t string, group *FilterGroup, sort *Sort, table string, perPage int, page int) (string, []interface{}, error) {
+	plan := &FilterQueryPlan{Limit: perPage, Offset: (page - 1) * perPage}
+	if group != nil {
+		condition, args, err := constructGroupCondition(t, group, table, 1)
+		if err != nil {
+			return "", nil, err
+		}
+		if condition != "" {
+			plan.Conditions = []string{condition}
+			plan.Args = args
+		}
+	}
+
+	orderBy, err := buildOrderBy(t, sort, table)
+	if err != nil {
+		return "", nil, err
+	}
+	plan.OrderBy = orderBy
+
+	return plan.SQL(baseQuery), plan.Args, nil
+}
+
+func buildOrderBy(t string, sort *Sort, table string) ([]string, error) {
+	sortClauses := []string{}
+	if sort == nil || len(*sort) == 0 {
+		return sortClauses, nil
+	}
+
+	modelInfo, ok := getModelInfo(table)
+	if !ok {
+		return nil, fmt.Errorf("table name not initialized: %s", table)
+	}
+
+	for field, order := range *sort {
+		order, err := sortOrder(order)
+		if err != nil {
+			return nil, err
+		}
+		dbField, exists := modelInfo.dbTagMap[field]
+		if exists {
+			if err := checkSortIndex(modelInfo, table, dbField); err != nil {
+				return nil, err
+			}
+			sortClauses = append(sortClauses, quoteTable(t)+"."+QuoteIdentifier(dbField)+" "+order)
+		} else if expr, ok := modelInfo.sortExprs[field]; ok {
+			sortClauses = append(sortClauses, expr.sql(t, modelInfo)+" "+order)
+		}
+	}
+	return sortClauses, nil
+}
+
+// SortMode is the sort index check applied by StrictSort
+type SortMode int
+
+const (
+	SortCheckOff   SortMode = iota // no check, the default
+	SortCheckWarn                  // report unindexed sorts to QueryLogger
+	SortCheckError                 // fail with ErrUnindexedSort
+)
+
+// StrictSort checks generated ORDER BY columns against the columns registered with
+// SetIndexedColumns, to catch accidental full-table sorts. Tables without registered
+// indexes are not checked.
+var StrictSort = SortCheckOff
+
+// ErrUnindexedSort is returned, or logged, when sorting by a column without a registered index
+var ErrUnindexedSort = errors.New("sort on unindexed column")
+
+func checkSortIndex(modelInfo *modelInfo, table, column string) error {
+	if StrictSort == SortCheckOff || modelInfo.indexedColumns == nil || column == modelInfo.primaryKey {
+		return nil
+	}
+	if _, ok := modelInfo.indexedColumns[column]; ok {
+		return nil
+	}
+
+	err := fmt.Errorf("%w: %s.%s", ErrUnindexedSort, table, column)
+	if StrictSort == SortCheckError {
+		return err
+	}
+	logSampled("sort", QueryEvent{Query: fmt.Sprintf(`ORDER BY %s.%s`, quoteTable(table), QuoteIdentifier(column)), Err: err, Table: table, Rows: -1})
+	return nil
+}
+
+// DefaultNullsOrder is appended to every generated ORDER BY field that doesn't set its own
+// NULLS FIRST/LAST. It is empty by default, keeping PostgreSQL's behavior (NULLs last for ASC,
+// first for DESC); set it to "NULLS LAST" or "NULLS FIRST" for a consistent policy.
+// A sort direction such as "DESC NULLS LAST" overrides it per field.
+var DefaultNullsOrder = ""
+
+// sortOrder validates a sort direction with an optional NULLS FIRST/LAST suffix
+func sortOrder(order string) (string, error) {
+	parts := strings.Fields(strings.ToUpper(order))
+	if len(parts) == 0 || (parts[0] != "ASC" && parts[0] != "DESC") {
+		return "", fmt.Errorf("invalid sort order: %s", order)
+	}
+
+	nulls := strings.ToUpper(DefaultNullsOrder)
+	switch len(parts) {
+	case 1:
+	case 3:
+		if parts[1] != "NULLS" || (parts[2] != "FIRST" && parts[2] != "LAST") {
+			return "", fmt.Errorf("invalid sort order: %s", order)
+		}
+		nulls = parts[1] + " " + parts[2]
+	default:
+		return "", fmt.Errorf("invalid sort order: %s", order)
+	}
+
+	if nulls == "" {
+		return parts[0], nil
+	}
+	return parts[0] + " " + nulls, nil
 }
 
 var reLimit = regexp.MustCompile(`(?i)\sLIMIT\s+\d+`)
-var reOffset = regexp.MustCompile(`(?i)\sOFFSET\s+\d+`)
-var reOrderBy = regexp.MustCompile(`(?i)\sORDER\s+BY\s+[^)]+`)
+var reOffset = regexp.MustCompile(`(?i)\sOFFSET\s+\d+(\s+ROWS)?`)
+var reFetch = regexp.MustCompile(`(?i)\sFETCH\s+FIRST\s+\d+\s+ROWS\s+WITH\s+TIES`)
+var reOrderBy = regexp.MustCompile(`(?i)\sORDER\s+BY\s`)
 
 func BuildFilterCount(baseQuery string) string {
 	// Remove LIMIT and OFFSET clauses
 	baseQuery = reLimit.ReplaceAllString(baseQuery, "")
 	baseQuery = reOffset.ReplaceAllString(baseQuery, "")
+	baseQuery = reFetch.ReplaceAllString(baseQuery, "")
 	baseQuery = strings.TrimSpace(baseQuery)
 
 	// Remove ORDER BY clause
-	baseQuery = reOrderBy.ReplaceAllString(baseQuery, "")
-	baseQuery = strings.TrimSpace(baseQuery)
+	baseQuery = strings.TrimSpace(stripOrderBy(baseQuery))
 
 	countQuery := fmt.Sprintf("SELECT COUNT(*) FROM (%s) AS count_subquery", baseQuery)
 	return countQuery
 }
 
+// stripOrderBy cuts the query at its last ORDER BY outside parentheses and string literals,
+// so sort expressions such as GREATEST(a, b) DESC are removed whole
+func stripOrderBy(query string) string {
+	depth := make([]int, len(query))
+	level, quoted := 0, false
+	for i, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			level++
+		case c == ')':
+			level--
+		}
+		depth[i] = level
+		if quoted {
+			depth[i] = -1
+		}
+	}
+
+	matches := reOrderBy.FindAllStringIndex(query, -1)
+	for i := len(matches) - 1; i >= 0; i-- {
+		if depth[matches[i][0]] == 0 {
+			return query[:matches[i][0]]
+		}
+	}
+	return query
+}
+
+// FilterCountQuery builds the count query matching FilterQuery's conditions for the builder,
+// counting the table directly when the builder has no joins or grouping.
+func FilterCountQuery(qb *QueryBuilder, t string, filters *Filter, table string) (string, []interface{}, error) {
+	if table == qb.Table && t != qb.Qualifier() {
+		return "", nil, fmt.Errorf("filter qualifier %s does not match the builder's %s", t, qb.Qualifier())
+	}
+	if qb.isSimpleCount() {
+		conditions, args, err := constructConditions(t, filters, table)
+		if err != nil {
+			return "", nil, err
+		}
+		query := qb.BuildCount()
+		if len(conditions) > 0 {
+			query += " WHERE " + strings.Join(conditions, " AND ")
+		}
+		return query, args, nil
+	}
+
+	_, args := qb.BuildWithArgs()
+	conditions, filterArgs, err := constructConditionsFrom(t, filters, table, len(args)+1)
+	if err != nil {
+		return "", nil, err
+	}
+	query, _ := qb.buildWhere(strings.Join(conditions, " AND "))
+	return fmt.Sprintf("SELECT COUNT(*) FROM (%s) AS count_subquery", query), append(args, filterArgs...), nil
+}
+
+// CountWhere counts the rows of a registered table matching filters
+func CountWhere(tableName string, filters *Filter) (int, error) {
+	return CountWhereContext(context.Background(), tableName, filters)
+}
+
+// CountWhereContext is CountWhere scoped to the tenant of ctx
+func CountWhereContext(ctx context.Context, tableName string, filters *Filter) (int, error) {
+	filters, err := scopeFilters(ctx, tableName, filters)
+	if err != nil {
+		return 0, err
+	}
+	query, args, err := SelectBase(tableName, "").FilterCountQuery(filters)
+	if err != nil {
+		return 0, err
+	}
+	return GetFilterCountContext(WithQueryTable(ctx, tableName), query, args)
+}
+
+// Exists reports whether a row of a registered table matches filters
+func Exists(tableName string, filters *Filter) (bool, error) {
+	return ExistsContext(context.Background(), tableName, filters)
+}
+
+// ExistsContext is Exists scoped to the tenant of ctx
+func ExistsContext(ctx context.Context, tableName string, filters *Filter) (bool, error) {
+	filters, err := scopeFilters(ctx, tableName, filters)
+	if err != nil {
+		return false, err
+	}
+	conditions, args, err := constructConditions(tableName, filters, tableName)
+	if err != nil {
+		return false, err
+	}
+
+	query := `SELECT 1 FROM ` + quoteTable(tableName)
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	var exists bool
+	err = GetContext(WithQueryTable(ctx, tableName), &exists, `SELECT EXISTS (`+query+`)`, args...)
+	return exists, err
+}
+
+// CountBy counts the rows of tableName matching filters per value of the model field,
+// like SELECT field, COUNT(*) ... GROUP BY field. Values are keyed as text and NULL
+// values are counted under the "" key, together with empty strings.
+func CountBy(tableName, field string, filters *Filter) (map[string]int, error) {
+	return CountByContext(context.Background(), tableName, field, filters)
+}
+
+// CountByContext is CountBy scoped to the tenant of ctx
+func CountByContext(ctx context.Context, tableName, field string, filters *Filter) (map[string]int, error) {
+	modelInfo, ok := getModelInfo(tableName)
+	if !ok {
+		return nil, fmt.Errorf("table name not initialized: %s", tableName)
+	}
+	dbField, ok := modelInfo.dbTagMap[field]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %s for table %s", field, tableName)
+	}
+
+	filters, err := scopeFilters(ctx, tableName, filters)
+	if err != nil {
+		return nil, err
+	}
+	conditions, args, err := constructConditions(tableName, filters, tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf(`SELECT (%s.%s)::text AS group_key, COUNT(*) AS group_count FROM %s`,
+		quoteTable(tableName), QuoteIdentifier(dbField), quoteTable(tableName))
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " GROUP BY 1"
+
+	var rows []struct {
+		Key   sql.NullString `db:"group_key"`
+		Count int            `db:"group_count"`
+	}
+	if err := SelectContext(WithQueryTable(ctx, tableName), &rows, query, args...); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(rows))
+	for _, row := range rows {
+		counts[row.Key.String] += row.Count
+	}
+	return counts, nil
+}
+
+// EstimateCount returns the planner's row estimate of a registered table from pg_class.reltuples,
+// instantly but approximately, for "about N results" displays where an exact COUNT(*) is too slow.
+// It is only as fresh as the last VACUUM or ANALYZE of the table, and -1 when it was never
+// analyzed (PostgreSQL 14+). Filters are not applied; use GetFilterCount for an exact count.
+func EstimateCount(tableName string) (int64, error) {
+	return EstimateCountContext(context.Background(), tableName)
+}
+
+// EstimateCountContext is EstimateCount with a context
+func EstimateCountContext(ctx context.Context, tableName string) (int64, error) {
+	if _, ok := getModelInfo(tableName); !ok {
+		return 0, fmt.Errorf("table name not initialized: %s", tableName)
+	}
+	var estimate int64
+	err := GetContext(WithQueryTable(ctx, tableName), &estimate, `SELECT reltuples::bigint FROM pg_class WHERE oid = to_regclass($1)`, quoteTable(tableName))
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("table %s not found", tableName)
+	}
+	return estimate, err
+}
+
 func GetFilterCount(query string, args []interface{}) (int, error) {
+	return GetFilterCountContext(context.Background(), query, args)
+}
+
+// GetFilterCountContext is GetFilterCount with a context
+func GetFilterCountContext(ctx context.Context, query string, args []interface{}) (int, error) {
 	var count int
-	err := Db.QueryRow(query, args...).Scan(&count)
+	err := GetContext(ctx, &count, query, args...)
 	return count, err
 }
 
+// SafeOrderBy builds an ORDER BY list for FilterQueryCustom from a client-supplied
+// "field:dir,field2" string. Every field must be a key of allowed, which maps it to the
+// trusted column expression; the direction defaults to ASC. An empty input gives "".
+func SafeOrderBy(input string, allowed map[string]string) (string, error) {
+	clauses := []string{}
+	for _, part := range strings.Split(input, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		field, dir, _ := strings.Cut(part, ":")
+		column, ok := allowed[strings.TrimSpace(field)]
+		if !ok {
+			return "", fmt.Errorf("sorting by %s is not allowed", field)
+		}
+		if strings.TrimSpace(dir) == "" {
+			dir = "ASC"
+		}
+		order, err := sortOrder(dir)
+		if err != nil {
+			return "", err
+		}
+		clauses = append(clauses, column+" "+order)
+	}
+	return strings.Join(clauses, ", "), nil
+}
+
+// FilterFromQuery translates URL query parameters into a Filter and a Sort. allowed maps the
+// accepted parameter names to model field names; a parameter may carry an operator suffix such
+// as "price[$gte]", which must be a built-in or registered operator. $in, $nin and $arraycontains
+// take repeated or comma-separated values, $between exactly two. The "sort" parameter lists
+// allowed names, optionally as "name:desc", and "order" gives the default direction. Other
+// parameters not in allowed are rejected, except "page" and "per_page".
+func FilterFromQuery(values url.Values, allowed map[string]string) (*Filter, *Sort, error) {
+	filters := Filter{}
+	var sortBy *Sort
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		switch key {
+		case "page", "per_page", "order":
+			continue
+		case "sort":
+			s, err := sortFromQuery(values.Get("sort"), values.Get("order"), allowed)
+			if err != nil {
+				return nil, nil, err
+			}
+			sortBy = &s
+			continue
+		}
+
+		name, operator := key, ""
+		if i := strings.Index(key, "["); i >= 0 && strings.HasSuffix(key, "]") {
+			name, operator = key[:i], key[i+1:len(key)-1]
+		}
+		field, ok := allowed[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("filtering by %s is not allowed", name)
+		}
+		if operator != "" && !isBuiltinOperator(operator) {
+			if _, ok := customOperators.Get(operator); !ok {
+				return nil, nil, fmt.Errorf("unknown operator %s in parameter %s", operator, key)
+			}
+		}
+
+		var params []string
+		for _, value := range values[key] {
+			params = append(params, strings.Split(value, ",")...)
+		}
+		switch operator {
+		case "$in", "$nin", "$arraycontains":
+			filters[field+"["+operator+"]"] = params
+		case "$between":
+			if len(params) != 2 {
+				return nil, nil, fmt.Errorf("$between on %s expects two values", name)
+			}
+			filters[field+"["+operator+"]"] = params
+		default:
+			if len(values[key]) != 1 {
+				return nil, nil, fmt.Errorf("parameter %s has multiple values", key)
+			}
+			filterKey := field
+			if operator != "" {
+				filterKey += "[" + operator + "]"
+			}
+			filters[filterKey] = values[key][0]
+		}
+	}
+	return &filters, sortBy, nil
+}
+
+// sortFromQuery parses the "sort" and "order" parameters of FilterFromQuery
+func sortFromQuery(input, defaultOrder string, allowed map[string]string) (Sort, error) {
+	if defaultOrder == "" {
+		defaultOrder = "ASC"
+	}
+	s := Sort{}
+	for _, part := range strings.Split(input, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, dir, _ := strings.Cut(part, ":")
+		field, ok := allowed[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("sorting by %s is not allowed", name)
+		}
+		if strings.TrimSpace(dir) == "" {
+			dir = defaultOrder
+		}
+		order, err := sortOrder(dir)
+		if err != nil {
+			return nil, err
+		}
+		s[field] = order
+	}
+	return s, nil
+}
+
 func FilterQueryCustom(baseQuery string, t string, orderBy string, args []interface{}, perPage int, page int) (string, []interface{}, error) {
 	limit := perPage
 	offset := (page - 1) * perPage
 
-	baseQuery += fmt.Sprintf(" ORDER BY %s", orderBy)
-	baseQuery += fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
+	if orderBy != "" {
+		baseQuery += fmt.Sprintf(" ORDER BY %s", orderBy)
+	}
+	if limit > 0 {
+		baseQuery += fmt.Sprintf(" LIMIT %d OFFSET %d", limit, offset)
+	}
 	return baseQuery, args, nil
 }
 
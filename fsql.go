@@ -2,30 +2,292 @@
 package fsql
 
 import (
+	"context"
+	"database/sql"
+	"fmt"
 	"log"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/jmoiron/sqlx" // SQL library
+	"github.com/jmoiron/sqlx/reflectx"
 	_ "github.com/lib/pq" // PostgreSQL driver
 )
 
 var Db *sqlx.DB
 
+// Config holds the connection pool settings used by InitDBWithConfig
+type Config struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+
+	// ConnMaxIdleTime closes connections idle for longer, so connections left stale by a
+	// database restart are recycled before use. Zero keeps idle connections.
+	ConnMaxIdleTime time.Duration
+
+	// HealthCheckInterval pings the pool in the background at this interval. A failed ping is
+	// reported to QueryLogger and flushes the idle connections. Zero disables it.
+	HealthCheckInterval time.Duration
+
+	// WarmUp eagerly opens MinIdleConns connections before returning. It requires
+	// MaxIdleConns > 0, as the pool would close the warmed connections right away.
+	WarmUp       bool
+	MinIdleConns int
+
+	// SearchPath is sent as a startup parameter so every pooled connection uses it
+	SearchPath string
+}
+
+// DefaultConfig returns the pool settings used by InitDB
+func DefaultConfig() Config {
+	return Config{
+		MaxOpenConns:    25,
+		MaxIdleConns:    25,
+		ConnMaxLifetime: 5 * time.Minute,
+	}
+}
+
 func InitDB(database string) {
+	if err := InitDBWithConfig(database, DefaultConfig()); err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+}
+
+// InitDBWithConfig connects to the database and applies the pool settings from cfg
+func InitDBWithConfig(database string, cfg Config) error {
+	if cfg.WarmUp && cfg.MinIdleConns > 0 && cfg.MaxIdleConns <= 0 {
+		return fmt.Errorf("config: warm-up of %d connections requires MaxIdleConns > 0", cfg.MinIdleConns)
+	}
+	if cfg.SearchPath != "" {
+		database = withDSNParam(database, "search_path", cfg.SearchPath)
+	}
+
 	var err error
 	Db, err = sqlx.Connect("postgres", database)
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		return err
+	}
+
+	if LowercaseIdentifiers {
+		Db.Mapper = reflectx.NewMapperTagFunc("db", strings.ToLower, strings.ToLower)
+	}
+
+	Db.SetMaxOpenConns(cfg.MaxOpenConns)
+	Db.SetMaxIdleConns(cfg.MaxIdleConns)
+	Db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	Db.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+
+	stopHealthCheck()
+	if cfg.HealthCheckInterval > 0 {
+		startHealthCheck(Db, cfg.HealthCheckInterval, cfg.MaxIdleConns)
+	}
+
+	if cfg.WarmUp {
+		return warmUp(warmUpConns(cfg))
+	}
+	return nil
+}
+
+// warmUpTimeout bounds the wait for the warm-up connections
+const warmUpTimeout = 30 * time.Second
+
+// warmUpConns clamps MinIdleConns to the connections the pool can both open at once and keep
+// idle, so the warm-up neither blocks on MaxOpenConns nor opens connections closed on release
+func warmUpConns(cfg Config) int {
+	n := cfg.MinIdleConns
+	if cfg.MaxOpenConns > 0 && n > cfg.MaxOpenConns {
+		n = cfg.MaxOpenConns
+	}
+	if n > cfg.MaxIdleConns {
+		n = cfg.MaxIdleConns
+	}
+	if n < 0 {
+		n = 0
+	}
+	return n
+}
+
+// warmUp holds n connections at once so the pool has to open each of them,
+// then releases them back as idle connections.
+func warmUp(n int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), warmUpTimeout)
+	defer cancel()
+
+	conns := make([]*sql.Conn, n)
+	errs := make([]error, n)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conns[i], errs[i] = Db.Conn(ctx)
+			if errs[i] == nil {
+				errs[i] = conns[i].PingContext(ctx)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var firstErr error
+	for i := 0; i < n; i++ {
+		if conns[i] != nil {
+			conns[i].Close()
+		}
+		if errs[i] != nil && firstErr == nil {
+			firstErr = fmt.Errorf("warm-up failed: %w", errs[i])
+		}
+	}
+	return firstErr
+}
+
+var (
+	healthCheckStop chan struct{}
+	healthCheckMu   sync.Mutex
+)
+
+// startHealthCheck pings db every interval until stopHealthCheck
+func startHealthCheck(db *sqlx.DB, interval time.Duration, maxIdleConns int) {
+	healthCheckMu.Lock()
+	defer healthCheckMu.Unlock()
+	stop := make(chan struct{})
+	healthCheckStop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				checkHealth(db, interval, maxIdleConns)
+			}
+		}
+	}()
+}
+
+func checkHealth(db *sqlx.DB, timeout time.Duration, maxIdleConns int) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		logSampled("health", QueryEvent{Query: "PING", Err: fmt.Errorf("health check failed: %w", err), Rows: -1})
+		// Drop the idle connections so the next queries open fresh ones
+		db.SetMaxIdleConns(0)
+		db.SetMaxIdleConns(maxIdleConns)
+	}
+}
+
+func stopHealthCheck() {
+	healthCheckMu.Lock()
+	defer healthCheckMu.Unlock()
+	if healthCheckStop != nil {
+		close(healthCheckStop)
+		healthCheckStop = nil
+	}
+}
+
+// DSN holds the components of a PostgreSQL keyword/value connection string
+type DSN struct {
+	Host           string
+	Port           int
+	User           string
+	Password       string
+	DBName         string
+	SSLMode        string
+	ConnectTimeout time.Duration
+}
+
+var sslModes = map[string]struct{}{
+	"disable":     {},
+	"allow":       {},
+	"prefer":      {},
+	"require":     {},
+	"verify-ca":   {},
+	"verify-full": {},
+}
+
+// String builds the connection string, quoting values as required by libpq
+func (d DSN) String() string {
+	parts := []string{}
+	add := func(key, value string) {
+		if value != "" {
+			parts = append(parts, key+"="+quoteDSNValue(value))
+		}
+	}
+
+	add("host", d.Host)
+	if d.Port > 0 {
+		add("port", strconv.Itoa(d.Port))
+	}
+	add("user", d.User)
+	add("password", d.Password)
+	add("dbname", d.DBName)
+	add("sslmode", d.SSLMode)
+	if d.ConnectTimeout > 0 {
+		// libpq takes whole seconds and treats 0 as no timeout, so round up
+		add("connect_timeout", strconv.Itoa(int(math.Ceil(d.ConnectTimeout.Seconds()))))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func quoteDSNValue(value string) string {
+	if !strings.ContainsAny(value, `'\`) && strings.IndexFunc(value, unicode.IsSpace) < 0 {
+		return value
+	}
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+// withDSNParam adds a parameter to a keyword/value or URL connection string
+func withDSNParam(database, key, value string) string {
+	if strings.HasPrefix(database, "postgres://") || strings.HasPrefix(database, "postgresql://") {
+		u, err := url.Parse(database)
+		if err == nil {
+			q := u.Query()
+			q.Set(key, value)
+			u.RawQuery = q.Encode()
+			return u.String()
+		}
+	}
+	return strings.TrimSpace(database + " " + key + "=" + quoteDSNValue(value))
+}
+
+// SetSearchPath sets the search_path for the rest of the transaction only (SET LOCAL),
+// so it never leaks to the pooled connection once tx ends.
+func SetSearchPath(ctx context.Context, tx *sqlx.Tx, schema string) error {
+	_, err := tx.ExecContext(ctx, "SET LOCAL search_path TO "+quoteTable(schema))
+	return err
+}
+
+// InitDBFromDSN validates cfg and initializes the database connection with it
+func InitDBFromDSN(cfg DSN) error {
+	if cfg.Host == "" {
+		return fmt.Errorf("dsn: host is required")
+	}
+	if cfg.DBName == "" {
+		return fmt.Errorf("dsn: dbname is required")
+	}
+	if cfg.SSLMode != "" {
+		if _, ok := sslModes[cfg.SSLMode]; !ok {
+			return fmt.Errorf("dsn: invalid sslmode: %s", cfg.SSLMode)
+		}
 	}
 
-	// Set reasonable limits
-	Db.SetMaxOpenConns(25)
-	Db.SetMaxIdleConns(25)
-	Db.SetConnMaxLifetime(5 * time.Minute)
+	return InitDBWithConfig(cfg.String(), DefaultConfig())
 }
 
 // CloseDB closes the database connection
 func CloseDB() {
+	stopHealthCheck()
 	if Db != nil {
 		if err := Db.Close(); err != nil {
 			log.Printf("Error closing database: %v", err)
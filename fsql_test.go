@@ -2,17 +2,26 @@
 package fsql
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"math"
+	"net/url"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/Fy-/octypes"
-	_ "github.com/lib/pq" // PostgreSQL driver
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 type AIModelTest struct {
@@ -82,6 +91,7 @@ func TestMain(m *testing.M) {
 
 func InitAIModel() {
 	InitModelTagCache(AIModelTest{}, "ai_model")
+	SetDefaultSort("ai_model", Sort{"Type": "ASC"})
 	aiModelBaseQuery = SelectBase("ai_model", "").Build()
 }
 
@@ -96,8 +106,7 @@ func initWebsiteModel() {
 }
 
 func cleanDatabase() error {
-	_, err := Db.Exec(`TRUNCATE TABLE ai_model, website, realm RESTART IDENTITY CASCADE`)
-	return err
+	return TruncateWith(TruncateOptions{RestartIdentity: true, Cascade: true}, "ai_model", "website", "realm")
 }
 
 func TestAIModelInsertAndFetch(t *testing.T) {
@@ -162,10 +171,11 @@ func TestListAIModel(t *testing.T) {
 	sort := &Sort{
 		"Key": "ASC",
 	}
-	models, pagination, err := ListAIModel(filters, sort, perPage, page)
+	result, err := ListAIModel(filters, sort, perPage, page)
 	if err != nil {
 		t.Fatalf("ListAIModel error: %v", err)
 	}
+	models, pagination := &result.Data, &result.Pagination
 
 	expectedCount := 50
 	if pagination.Count != expectedCount {
@@ -247,14 +257,15 @@ func TestLinkedFields(t *testing.T) {
 }
 
 func AIModelByUUID(uuidStr string) (*AIModelTest, error) {
-	query := aiModelBaseQuery + ` WHERE "ai_model".uuid = $1 LIMIT 1`
-	model := AIModelTest{}
-
-	err := Db.Get(&model, query, uuidStr)
+	query := aiModelBaseQuery + ` WHERE "ai_model"."uuid" = $1 LIMIT 1`
+	model, err := GetStruct[AIModelTest](query, uuidStr)
 	if err != nil {
 		return nil, err
 	}
-	return &model, nil
+	if model == nil {
+		return nil, sql.ErrNoRows
+	}
+	return model, nil
 }
 
 func (m *AIModelTest) Insert() error {
@@ -276,50 +287,2621 @@ func (m *AIModelTest) Insert() error {
 	return nil
 }
 
-func ListAIModel(filters *Filter, sort *Sort, perPage int, page int) (*[]AIModelTest, *octypes.Pagination, error) {
-	if sort == nil || len(*sort) == 0 {
-		sort = &Sort{
-			"Type": "ASC",
+func ListAIModel(filters *Filter, sort *Sort, perPage int, page int) (*PaginatedResult[AIModelTest], error) {
+	return List[AIModelTest](aiModelBaseQuery, "ai_model", filters, sort, "ai_model", perPage, page)
+}
+
+func GetWebsiteByUUID(uuid string) (*WebsiteTest, error) {
+	query := websiteQuerySelectBase + ` WHERE "website"."uuid" = $1 LIMIT 1`
+	website := WebsiteTest{}
+
+	err := Db.Get(&website, query, uuid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &website, nil
+}
+
+func TestGenerateCreateTable(t *testing.T) {
+	query := GenerateCreateTable("realm")
+
+	expected := "CREATE TABLE \"realm\" (\n" +
+		"    \"uuid\" text,\n" +
+		"    \"created_at\" timestamptz DEFAULT NOW(),\n" +
+		"    \"updated_at\" timestamptz DEFAULT NOW(),\n" +
+		"    \"name\" text\n" +
+		");"
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+
+	types := []struct {
+		value    interface{}
+		expected string
+	}{
+		{NullBytes{}, "bytea"},
+		{&NullBytes{}, "bytea"},
+		{Float64Array{}, "double precision[]"},
+		{HStore{}, "hstore"},
+		{Money(0), "numeric(20,2)"},
+		{[]byte{}, "bytea"},
+		{octypes.NullInt64{}, "bigint"},
+	}
+	for _, tt := range types {
+		if sqlType, ok := sqlTypeFor(reflect.TypeOf(tt.value)); !ok || sqlType != tt.expected {
+			t.Errorf("Expected %T to map to %s, got %q", tt.value, tt.expected, sqlType)
+		}
+	}
+}
+
+func TestDSNString(t *testing.T) {
+	dsn := DSN{
+		Host:           "localhost",
+		Port:           5432,
+		User:           "test_user",
+		Password:       `it's a \secret`,
+		DBName:         "test_db",
+		SSLMode:        "disable",
+		ConnectTimeout: 5 * time.Second,
+	}
+
+	expected := `host=localhost port=5432 user=test_user password='it\'s a \\secret' dbname=test_db sslmode=disable connect_timeout=5`
+	if dsn.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, dsn.String())
+	}
+
+	dsn = DSN{Host: "localhost", Password: "tab\tsecret", ConnectTimeout: 500 * time.Millisecond}
+	expected = "host=localhost password='tab\tsecret' connect_timeout=1"
+	if dsn.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, dsn.String())
+	}
+
+	if err := InitDBFromDSN(DSN{Host: "localhost", DBName: "test_db", SSLMode: "disabled"}); err == nil {
+		t.Errorf("Expected error for invalid sslmode")
+	}
+}
+
+func TestSetSearchPath(t *testing.T) {
+	ctx := context.Background()
+	conn, err := Db.Connx(ctx)
+	if err != nil {
+		t.Fatalf("Connx error: %v", err)
+	}
+	defer conn.Close()
+
+	var before, during, after string
+	if err := conn.GetContext(ctx, &before, "SHOW search_path"); err != nil {
+		t.Fatalf("SHOW search_path error: %v", err)
+	}
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		t.Fatalf("Begin error: %v", err)
+	}
+	defer tx.Rollback()
+	if err := SetSearchPath(ctx, tx, "pg_catalog"); err != nil {
+		t.Fatalf("SetSearchPath error: %v", err)
+	}
+	if err := tx.GetContext(ctx, &during, "SHOW search_path"); err != nil {
+		t.Fatalf("SHOW search_path error: %v", err)
+	}
+	if during != "pg_catalog" {
+		t.Errorf("Expected the search_path to be pg_catalog inside the transaction, got %q", during)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit error: %v", err)
+	}
+
+	if err := conn.GetContext(ctx, &after, "SHOW search_path"); err != nil {
+		t.Fatalf("SHOW search_path error: %v", err)
+	}
+	if after != before {
+		t.Errorf("Expected the search_path to revert to %q after commit, got %q", before, after)
+	}
+}
+
+func TestWarmUpConns(t *testing.T) {
+	tests := []struct {
+		cfg      Config
+		expected int
+	}{
+		{Config{MaxOpenConns: 25, MaxIdleConns: 5, MinIdleConns: 50}, 5},
+		{Config{MaxOpenConns: 2, MaxIdleConns: 5, MinIdleConns: 50}, 2},
+		{Config{MaxOpenConns: 0, MaxIdleConns: 10, MinIdleConns: 4}, 4},
+		{Config{MaxOpenConns: 25, MaxIdleConns: 25, MinIdleConns: -1}, 0},
+	}
+	for _, test := range tests {
+		if n := warmUpConns(test.cfg); n != test.expected {
+			t.Errorf("warmUpConns(%+v) = %d, expected %d", test.cfg, n, test.expected)
+		}
+	}
+
+	db := Db
+	err := InitDBWithConfig("host=localhost dbname=test_db", Config{MaxOpenConns: 25, WarmUp: true, MinIdleConns: 4})
+	if err == nil || !strings.Contains(err.Error(), "MaxIdleConns") {
+		t.Errorf("Expected a warm-up without idle connections to be rejected, got %v", err)
+	}
+	if Db != db {
+		t.Errorf("Expected the rejected config to leave the connection untouched")
+	}
+}
+
+func TestFilterGroupNegate(t *testing.T) {
+	group := &FilterGroup{
+		Filter: Filter{"Key": "key_1"},
+		Groups: []FilterGroup{
+			{Filter: Filter{"Type": "test_type"}, Negate: true},
+			{Filter: Filter{"Provider": "test_provider"}},
+		},
+		Or: true,
+	}
+
+	query, args, err := FilterGroupQuery("SELECT 1 FROM \"ai_model\"", "ai_model", group, nil, "ai_model", 10, 1)
+	if err != nil {
+		t.Fatalf("FilterGroupQuery error: %v", err)
+	}
+
+	expected := `SELECT 1 FROM "ai_model" WHERE ("ai_model"."key" = $1 OR NOT ("ai_model"."type" = $2) OR ("ai_model"."provider" = $3)) LIMIT 10 OFFSET 0`
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+	if len(args) != 3 || args[0] != "key_1" || args[1] != "test_type" || args[2] != "test_provider" {
+		t.Errorf("Unexpected args: %v", args)
+	}
+}
+
+func TestGroupCount(t *testing.T) {
+	qb := SelectBase("ai_model", "").GroupBy("Provider").GroupCount()
+	query, args, err := qb.FilterQuery(&Filter{"Type": "test_type"}, nil, 10, 1)
+	if err != nil {
+		t.Fatalf("FilterQuery error: %v", err)
+	}
+
+	expected := `SELECT "ai_model"."provider", COUNT(*) AS "group_count" FROM "ai_model"  WHERE "ai_model"."type" = $1 GROUP BY "ai_model"."provider" LIMIT 10 OFFSET 0`
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+	if len(args) != 1 {
+		t.Errorf("Expected 1 arg, got %d", len(args))
+	}
+}
+
+func TestFilterQueryGroupedSubquery(t *testing.T) {
+	base := aiModelBaseQuery + ` LEFT JOIN (SELECT provider, COUNT(*) AS n FROM ai_model GROUP BY provider) x ON x.provider = "ai_model"."provider"`
+	query, _, err := FilterQuery(base, "ai_model", &Filter{"Type": "test_type"}, nil, "ai_model", 0, 1)
+	if err != nil {
+		t.Fatalf("FilterQuery error: %v", err)
+	}
+	if !strings.HasSuffix(query, `ON x.provider = "ai_model"."provider" WHERE "ai_model"."type" = $1`) {
+		t.Errorf("Expected the WHERE after the subquery join, got %q", query)
+	}
+}
+
+func TestLikePatterns(t *testing.T) {
+	tests := []struct {
+		got      string
+		expected string
+	}{
+		{LikePrefix("100%"), `100\%%`},
+		{LikeSuffix("snake_case"), `%snake\_case`},
+		{LikeContains(`a\b`), `%a\\b%`},
+		{LikeContains("50%_off"), `%50\%\_off%`},
+	}
+
+	for _, test := range tests {
+		if test.got != test.expected {
+			t.Errorf("Expected %q, got %q", test.expected, test.got)
+		}
+	}
+}
+
+func TestGetUpdateQueryE(t *testing.T) {
+	if _, _, err := GetUpdateQueryE("unknown_table", map[string]interface{}{}, "uuid"); err == nil {
+		t.Errorf("Expected error for uninitialized table")
+	}
+	if _, _, err := GetUpdateQueryE("realm", map[string]interface{}{"uuid": "x"}, "uuid"); err == nil {
+		t.Errorf("Expected error when there are no fields to update")
+	}
+	if _, _, err := GetUpdateQueryE("realm", map[string]interface{}{"name": "x"}, "uuid"); err == nil {
+		t.Errorf("Expected error when the key is missing")
+	}
+
+	query, args, err := GetUpdateQueryE("realm", map[string]interface{}{"uuid": "x", "name": "y"}, "uuid")
+	if err != nil {
+		t.Fatalf("GetUpdateQueryE error: %v", err)
+	}
+	expected := `UPDATE "realm" SET "name" = $1 WHERE "realm"."uuid" = $2 RETURNING "realm"."uuid"`
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+	if len(args) != 2 {
+		t.Errorf("Expected 2 args, got %d", len(args))
+	}
+}
+
+func TestDbUpdateValue(t *testing.T) {
+	type DocumentTest struct {
+		UUID      string    `db:"uuid" dbMode:"i"`
+		Title     string    `db:"title" dbMode:"i,u"`
+		Revision  int       `db:"revision" dbMode:"i" dbUpdateValue:"revision + 1"`
+		UpdatedAt time.Time `db:"updated_at" dbMode:"i" dbInsertValue:"NOW()" dbUpdateValue:"NOW()"`
+	}
+	InitModelTagCache(DocumentTest{}, "document_test")
+
+	query, args, err := GetUpdateQueryE("document_test", map[string]interface{}{"uuid": "x", "title": "y"}, "uuid")
+	if err != nil {
+		t.Fatalf("GetUpdateQueryE error: %v", err)
+	}
+	expected := `UPDATE "document_test" SET "title" = $1, "revision" = revision + 1, "updated_at" = NOW() WHERE "document_test"."uuid" = $2 RETURNING "document_test"."uuid"`
+	if query != expected || len(args) != 2 {
+		t.Errorf("Expected %q, got %q with %v", expected, query, args)
+	}
+}
+
+func TestFlatAliases(t *testing.T) {
+	query := SelectBase("website", "website").Left("realm", "r", "website.realm_uuid = r.uuid").Flat().Build()
+	expected := `"r"."name" AS "r_name"`
+	if !strings.Contains(query, expected) {
+		t.Errorf("Expected %q in %q", expected, query)
+	}
+}
+
+func TestVerifySchema(t *testing.T) {
+	for _, table := range []string{"ai_model", "realm", "website"} {
+		if err := VerifySchemaStrict(table); err != nil {
+			t.Errorf("VerifySchemaStrict(%s) error: %v", table, err)
 		}
 	}
-	query := aiModelBaseQuery
-	query, args, err := FilterQuery(query, "ai_model", filters, sort, "ai_model", perPage, page)
+
+	type UnknownTable struct {
+		UUID string `db:"uuid" dbMode:"i"`
+	}
+	InitModelTagCache(UnknownTable{}, "missing_table")
+	if err := VerifySchema("missing_table"); err == nil {
+		t.Errorf("Expected error for missing table")
+	}
+}
+
+func TestGetUpdateJSONFieldQuery(t *testing.T) {
+	query, args, err := GetUpdateJSONFieldQuery("ai_model", "settings", []string{"sampler", "it's"}, 0.5, "uuid", "x")
 	if err != nil {
-		return nil, nil, err
+		t.Fatalf("GetUpdateJSONFieldQuery error: %v", err)
+	}
+
+	expected := `UPDATE "ai_model" SET "settings" = jsonb_set(COALESCE("settings", '{}'::jsonb), '{"sampler","it''s"}', $1::jsonb) WHERE "ai_model"."uuid" = $2`
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+	if len(args) != 2 || args[0] != "0.5" {
+		t.Errorf("Unexpected args: %v", args)
+	}
+
+	if _, _, err := GetUpdateJSONFieldQuery("ai_model", "uuid", []string{"a"}, 1, "uuid", "x"); err == nil {
+		t.Errorf("Expected error for non-updatable column")
+	}
+}
+
+func TestBulkUpdate(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
 	}
 
 	models := []AIModelTest{}
-	err = Db.Select(&models, query, args...)
+	rows := []map[string]interface{}{}
+	for i := 1; i <= 3; i++ {
+		aiModel := AIModelTest{
+			Key:      *octypes.NewNullString(fmt.Sprintf("key_%d", i)),
+			Type:     *octypes.NewNullString("test_type"),
+			Provider: *octypes.NewNullString("test_provider"),
+		}
+		if err := aiModel.Insert(); err != nil {
+			t.Fatalf("Insert error: %v", err)
+		}
+		models = append(models, aiModel)
+		rows = append(rows, map[string]interface{}{
+			"uuid":     aiModel.UUID,
+			"provider": fmt.Sprintf("provider_%d", i),
+		})
+	}
+
+	updated, err := BulkUpdate("ai_model", "uuid", rows)
+	if err != nil {
+		t.Fatalf("BulkUpdate error: %v", err)
+	}
+	if updated != 3 {
+		t.Errorf("Expected 3 updated rows, got %d", updated)
+	}
+
+	for i, model := range models {
+		fetchedModel, err := AIModelByUUID(model.UUID.String)
+		if err != nil {
+			t.Fatalf("Fetch error: %v", err)
+		}
+		expected := fmt.Sprintf("provider_%d", i+1)
+		if fetchedModel.Provider.String != expected {
+			t.Errorf("Expected provider %s, got %s", expected, fetchedModel.Provider.String)
+		}
+	}
+
+	reversed := []map[string]interface{}{
+		{"uuid": models[2].UUID, "provider": "reversed_3"},
+		{"uuid": models[0].UUID, "provider": "reversed_1"},
+	}
+	var returned []struct {
+		UUID     string `db:"uuid"`
+		Provider string `db:"provider"`
+	}
+	if err := BulkUpdateReturning(&returned, "ai_model", "uuid", reversed, "uuid", "provider"); err != nil {
+		t.Fatalf("BulkUpdateReturning error: %v", err)
+	}
+	if len(returned) != 2 || returned[0].UUID != models[2].UUID.String || returned[1].Provider != "reversed_1" {
+		t.Errorf("Expected the updated rows in input order, got %+v", returned)
+	}
+}
+
+func TestInsertGeneratesUUID(t *testing.T) {
+	type EventTest struct {
+		UUID string `db:"uuid" dbMode:"pk,uuid"`
+		Name string `db:"name" dbMode:"i,u"`
+	}
+	InitModelTagCache(EventTest{}, "event_test")
+
+	valuesMap := map[string]interface{}{"name": "created"}
+	query, args := GetInsertQuery("event_test", valuesMap, "uuid")
+
+	expected := `INSERT INTO "event_test" ("uuid","name") VALUES ($1,$2) RETURNING "event_test"."uuid"`
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+	if generated, ok := args[0].(string); !ok || generated == "" {
+		t.Fatalf("Expected generated UUID as first arg, got %v", args[0])
+	}
+	if _, ok := valuesMap["uuid"]; ok || len(valuesMap) != 1 {
+		t.Errorf("Expected valuesMap untouched, got %v", valuesMap)
+	}
+
+	_, again := GetInsertQuery("event_test", valuesMap, "uuid")
+	if again[0] == args[0] {
+		t.Errorf("Expected a new UUID for a reused valuesMap, got %v twice", args[0])
+	}
+
+	query, args = GetInsertQuery("event_test", nil, "uuid")
+	if !strings.HasPrefix(query, `INSERT INTO "event_test" ("uuid","name") VALUES ($1,DEFAULT)`) || len(args) != 1 {
+		t.Errorf("Unexpected insert query for nil valuesMap %q with %v", query, args)
+	}
+}
+
+func TestHStore(t *testing.T) {
+	var null HStore
+	if err := null.Scan(nil); err != nil {
+		t.Fatalf("Scan error: %v", err)
+	}
+	if null != nil {
+		t.Errorf("Expected nil map for a NULL hstore, got %v", null)
+	}
+	if value, err := null.Value(); err != nil || value != nil {
+		t.Errorf("Expected a nil map to be written as NULL, got %v, %v", value, err)
+	}
+
+	var hs HStore
+	if err := hs.Scan([]byte(`"a"=>"say \"hi\"", "back\\slash"=>"c:\\dir", "empty"=>NULL`)); err != nil {
+		t.Fatalf("Scan error: %v", err)
+	}
+	if len(hs) != 3 || hs["a"] == nil || *hs["a"] != `say "hi"` || hs["back\\slash"] == nil || *hs["back\\slash"] != `c:\dir` {
+		t.Errorf("Expected quotes and backslashes unescaped, got %v", hs)
+	}
+	if v, ok := hs["empty"]; !ok || v != nil {
+		t.Errorf("Expected a nil entry for a NULL value, got %v", v)
+	}
+
+	value, err := hs.Value()
 	if err != nil {
-		return nil, nil, err
+		t.Fatalf("Value error: %v", err)
+	}
+	var roundTrip HStore
+	if err := roundTrip.Scan(value); err != nil {
+		t.Fatalf("Scan error on %v: %v", value, err)
+	}
+	if !reflect.DeepEqual(roundTrip, hs) {
+		t.Errorf("Expected %v after a round trip, got %v", hs, roundTrip)
 	}
 
-	countQuery := BuildFilterCount(query)
-	count, err := GetFilterCount(countQuery, args)
+	data, err := json.Marshal(hs)
 	if err != nil {
-		return nil, nil, err
+		t.Fatalf("Marshal error: %v", err)
+	}
+	if string(data) != `{"a":"say \"hi\"","back\\slash":"c:\\dir","empty":null}` {
+		t.Errorf("Unexpected JSON %s", data)
+	}
+}
+
+func TestFloat64Array(t *testing.T) {
+	var arr Float64Array
+	if err := arr.Scan([]byte("{1.5,2,1e+06}")); err != nil {
+		t.Fatalf("Scan error: %v", err)
+	}
+	if len(arr) != 3 || arr[0] != 1.5 || arr[2] != 1000000 {
+		t.Errorf("Unexpected array: %v", arr)
+	}
+
+	var null Float64Array
+	if err := null.Scan(nil); err != nil {
+		t.Fatalf("Scan error: %v", err)
 	}
-	pagination := octypes.Pagination{
-		ResultsPerPage: perPage,
-		PageNo:         page,
-		Count:          count,
-		PageMax:        int(math.Ceil(float64(count) / float64(perPage))),
+	if null != nil {
+		t.Errorf("Expected nil array, got %v", null)
 	}
 
-	return &models, &pagination, nil
+	_, args, err := FilterQuery("", "ai_model", &Filter{"Type[$in]": Float64Array{1.5, 2}}, nil, "ai_model", 10, 1)
+	if err != nil {
+		t.Fatalf("FilterQuery error: %v", err)
+	}
+	if _, ok := args[0].(Float64Array); !ok {
+		t.Errorf("Expected Float64Array arg to be passed through, got %T", args[0])
+	}
 }
 
-func GetWebsiteByUUID(uuid string) (*WebsiteTest, error) {
-	query := websiteQuerySelectBase + ` WHERE "website".uuid = $1 LIMIT 1`
-	website := WebsiteTest{}
+func TestFilterCountQuery(t *testing.T) {
+	query, _, err := FilterCountQuery(SelectBase("ai_model", ""), "ai_model", &Filter{"Type": "test_type"}, "ai_model")
+	if err != nil {
+		t.Fatalf("FilterCountQuery error: %v", err)
+	}
+	expected := `SELECT COUNT(*) FROM "ai_model" WHERE "ai_model"."type" = $1`
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
 
-	err := Db.Get(&website, query, uuid)
+	qb := SelectBase("website", "website").Left("realm", "r", "website.realm_uuid = r.uuid")
+	query, _, err = FilterCountQuery(qb, "website", &Filter{"Domain": "example.com"}, "website")
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
+		t.Fatalf("FilterCountQuery error: %v", err)
+	}
+	if !strings.HasPrefix(query, "SELECT COUNT(*) FROM (SELECT ") || !strings.HasSuffix(query, `WHERE "website"."domain" = $1) AS count_subquery`) {
+		t.Errorf("Expected subquery count, got %q", query)
+	}
+}
+
+func TestCursor(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		aiModel := AIModelTest{
+			Key:      *octypes.NewNullString(fmt.Sprintf("key_%d", i)),
+			Type:     *octypes.NewNullString("test_type"),
+			Provider: *octypes.NewNullString("test_provider"),
+		}
+		if err := aiModel.Insert(); err != nil {
+			t.Fatalf("Insert error: %v", err)
 		}
-		return nil, err
 	}
 
-	return &website, nil
+	tx, err := Db.Beginx()
+	if err != nil {
+		t.Fatalf("Begin error: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := DeclareCursor(tx, "ai_model_cursor", aiModelBaseQuery+` ORDER BY "ai_model"."key"`); err != nil {
+		t.Fatalf("DeclareCursor error: %v", err)
+	}
+
+	total := 0
+	for {
+		batch, err := FetchCursor[AIModelTest](tx, "ai_model_cursor", 2)
+		if err != nil {
+			t.Fatalf("FetchCursor error: %v", err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		total += len(batch)
+	}
+	if total != 5 {
+		t.Errorf("Expected 5 rows, got %d", total)
+	}
+
+	if err := CloseCursor(tx, "ai_model_cursor"); err != nil {
+		t.Errorf("CloseCursor error: %v", err)
+	}
+}
+
+func TestIterateCursor(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		aiModel := AIModelTest{
+			Key:      *octypes.NewNullString(fmt.Sprintf("key_%d", i)),
+			Type:     *octypes.NewNullString("test_type"),
+			Provider: *octypes.NewNullString("test_provider"),
+		}
+		if err := aiModel.Insert(); err != nil {
+			t.Fatalf("Insert error: %v", err)
+		}
+	}
+
+	tx, err := Db.Beginx()
+	if err != nil {
+		t.Fatalf("Begin error: %v", err)
+	}
+	defer tx.Rollback()
+
+	openCursors := func(name string) int {
+		var count int
+		if err := tx.Get(&count, `SELECT COUNT(*) FROM pg_cursors WHERE name = $1`, name); err != nil {
+			t.Fatalf("pg_cursors error: %v", err)
+		}
+		return count
+	}
+
+	if err := DeclareCursor(tx, "all_models", aiModelBaseQuery); err != nil {
+		t.Fatalf("DeclareCursor error: %v", err)
+	}
+	total := 0
+	err = IterateCursor(context.Background(), tx, "all_models", 2, func(*AIModelTest) error {
+		total++
+		return nil
+	})
+	if err != nil || total != 5 {
+		t.Errorf("Expected 5 rows, got %d (%v)", total, err)
+	}
+	if openCursors("all_models") != 0 {
+		t.Errorf("Expected the cursor closed once exhausted")
+	}
+
+	if err := DeclareCursor(tx, "first_model", aiModelBaseQuery); err != nil {
+		t.Fatalf("DeclareCursor error: %v", err)
+	}
+	stop := errors.New("stop")
+	err = IterateCursor(context.Background(), tx, "first_model", 2, func(*AIModelTest) error {
+		return stop
+	})
+	if err != stop {
+		t.Errorf("Expected the fn error, got %v", err)
+	}
+	if openCursors("first_model") != 0 {
+		t.Errorf("Expected the cursor closed after an fn error")
+	}
+}
+
+func TestCursorLogging(t *testing.T) {
+	defer func(logger func(QueryEvent)) { QueryLogger = logger }(QueryLogger)
+	var events []QueryEvent
+	QueryLogger = func(e QueryEvent) { events = append(events, e) }
+
+	tx, err := Db.Beginx()
+	if err != nil {
+		t.Fatalf("Begin error: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := DeclareCursor(tx, "broken_cursor", `SELECT missing_column FROM ai_model WHERE type = $1`, "test_type"); err == nil {
+		t.Fatalf("Expected DECLARE error")
+	}
+	if len(events) != 1 || !strings.HasPrefix(events[0].Query, `DECLARE "broken_cursor"`) || len(events[0].Args) != 1 {
+		t.Errorf("Expected the failed DECLARE logged with its args, got %+v", events)
+	}
+}
+
+func TestSelectSubquery(t *testing.T) {
+	query := SelectBase("realm", "").SelectSubquery(`SELECT COUNT(*) FROM website WHERE website.realm_uuid = realm.uuid`, "website_count").Build()
+	expected := `, (SELECT COUNT(*) FROM website WHERE website.realm_uuid = realm.uuid) AS "website_count" FROM "realm"`
+	if !strings.Contains(query, expected) {
+		t.Errorf("Expected %q in %q", expected, query)
+	}
+}
+
+func TestSelectBaseAlias(t *testing.T) {
+	qb := SelectBase("realm", "r")
+	query := qb.Build()
+	expected := `SELECT "r"."uuid","r"."created_at","r"."updated_at","r"."name" FROM "realm" AS "r" `
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+
+	query, args, err := qb.FilterQuery(&Filter{"Name": "test"}, nil, 10, 1)
+	if err != nil {
+		t.Fatalf("FilterQuery error: %v", err)
+	}
+	if !strings.Contains(query, `WHERE "r"."name" = $1`) || len(args) != 1 {
+		t.Errorf("Expected conditions qualified with the alias, got %q", query)
+	}
+
+	if _, _, err := FilterCountQuery(qb, "realm", &Filter{"Name": "test"}, "realm"); err == nil {
+		t.Errorf("Expected an error for a qualifier not matching the builder alias")
+	}
+	query, _, err = qb.FilterCountQuery(&Filter{"Name": "test"})
+	if err != nil || query != `SELECT COUNT(*) FROM "realm" AS "r" WHERE "r"."name" = $1` {
+		t.Errorf("Unexpected count query %q, %v", query, err)
+	}
+
+	if count := qb.BuildCount(); count != `SELECT COUNT(*) FROM "realm" AS "r"` {
+		t.Errorf("Unexpected count query %q", count)
+	}
+	if SelectBase("realm", "realm").Build() != SelectBase("realm", "").Build() {
+		t.Errorf("Expected an alias equal to the table name to be ignored")
+	}
+
+	lookup := qb.WithValues("lookup", []string{"name"}, [][]interface{}{{"test"}})
+	query, countQuery, args, err := planList(lookup, "", lookup.Qualifier(), &Filter{"Name": "test"}, &Sort{"Name": "ASC"}, "realm", 10, 1)
+	if err != nil {
+		t.Fatalf("planList error: %v", err)
+	}
+	if !strings.HasSuffix(query, `FROM "realm" AS "r"  WHERE "r"."name" = $2 ORDER BY "r"."name" ASC LIMIT 10 OFFSET 0`) || len(args) != 2 {
+		t.Errorf("Expected the list qualified with the alias after the CTE args, got %q with %v", query, args)
+	}
+	if !strings.HasSuffix(countQuery, `FROM "realm" AS "r"  WHERE "r"."name" = $2) AS count_subquery`) {
+		t.Errorf("Unexpected list count query %q", countQuery)
+	}
+}
+
+func TestSelectJSONAgg(t *testing.T) {
+	query := SelectBase("realm", "").SelectJSONAgg("website", "websites", `"websites"."realm_uuid" = "realm"."uuid"`).Build()
+	expected := `(SELECT COALESCE(json_agg(json_build_object('uuid', "websites"."uuid", 'created_at', "websites"."created_at", 'updated_at', "websites"."updated_at", 'domain', "websites"."domain", 'realm_uuid', "websites"."realm_uuid")), '[]') FROM "website" AS "websites" WHERE "websites"."realm_uuid" = "realm"."uuid") AS "websites"`
+	if !strings.Contains(query, expected) {
+		t.Errorf("Expected %q in %q", expected, query)
+	}
+
+	var websites JSONSlice[WebsiteTest]
+	if err := websites.Scan([]byte(`[{"uuid": "w1", "domain": "a.com", "realm_uuid": "r1"}, {"uuid": "w2", "domain": "b.com", "realm_uuid": "r1"}]`)); err != nil {
+		t.Fatalf("Scan error: %v", err)
+	}
+	if len(websites) != 2 || websites[1].Domain != "b.com" || websites[0].RealmUUID != "r1" {
+		t.Errorf("Unexpected scanned websites %+v", websites)
+	}
+}
+
+func TestSample(t *testing.T) {
+	query := SelectBase("ai_model", "").Sample(1.5).GroupBy("Provider").GroupCount().Build()
+	expected := `FROM "ai_model" TABLESAMPLE SYSTEM (1.5)  GROUP BY "ai_model"."provider"`
+	if !strings.Contains(query, expected) {
+		t.Errorf("Expected %q in %q", expected, query)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected a panic for an out of range percent")
+		}
+	}()
+	SelectBase("ai_model", "").Sample(150)
+}
+
+func TestLocking(t *testing.T) {
+	query, _, err := SelectBase("ai_model", "").ForNoKeyUpdate().SkipLocked().FilterQuery(&Filter{"Type": "job"}, nil, 1, 1)
+	if err != nil {
+		t.Fatalf("FilterQuery error: %v", err)
+	}
+	if !strings.HasSuffix(query, `LIMIT 1 OFFSET 0 FOR NO KEY UPDATE SKIP LOCKED`) {
+		t.Errorf("Unexpected locking query %q", query)
+	}
+
+	query, _, err = SelectBase("website", "").Left("realm", "r", `"website"."realm_uuid" = r.uuid`).ForUpdate().FilterQuery(nil, nil, 1, 1)
+	if err != nil {
+		t.Fatalf("FilterQuery error: %v", err)
+	}
+	if !strings.HasSuffix(query, `FOR UPDATE OF "website"`) {
+		t.Errorf("Expected the lock restricted to the base table, got %q", query)
+	}
+
+	if query := SelectBase("ai_model", "").ForUpdate().Build(); !strings.HasSuffix(query, `FROM "ai_model"  FOR UPDATE`) {
+		t.Errorf("Expected Build to keep the lock, got %q", query)
+	}
+	qb := SelectBase("website", "w").Left("realm", "r", `"w"."realm_uuid" = r.uuid`).ForShare().NoWait()
+	if query, _ := qb.BuildWithArgs(); !strings.HasSuffix(query, `FOR SHARE OF "w" NOWAIT`) {
+		t.Errorf("Expected the lock restricted to the alias, got %q", query)
+	}
+	if query := qb.BuildCount(); strings.Contains(query, "FOR SHARE") {
+		t.Errorf("Expected an unlocked count, got %q", query)
+	}
+
+	type EventLogTest struct {
+		UUID string `db:"uuid" dbMode:"i"`
+		Name string `db:"name" dbMode:"i,u"`
+	}
+	InitModelTagCache(EventLogTest{}, "analytics.event_log")
+	query = SelectBase("analytics.event_log", "").Left("realm", "r", "true").ForUpdate().Build()
+	if !strings.HasSuffix(query, `FOR UPDATE OF "event_log"`) {
+		t.Errorf("Expected the unqualified table in OF, got %q", query)
+	}
+}
+
+func TestSchemaQualifiedTable(t *testing.T) {
+	type EventLogTest struct {
+		UUID string `db:"uuid" dbMode:"i"`
+		Name string `db:"name" dbMode:"i,u"`
+	}
+	InitModelTagCache(EventLogTest{}, "analytics.event_log")
+
+	query := SelectBase("analytics.event_log", "").Build()
+	expected := `SELECT "analytics"."event_log"."uuid","analytics"."event_log"."name" FROM "analytics"."event_log" `
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+
+	query, _ = GetInsertQuery("analytics.event_log", map[string]interface{}{"uuid": "x", "name": "y"}, "uuid")
+	expected = `INSERT INTO "analytics"."event_log" ("uuid","name") VALUES ($1,$2) RETURNING "analytics"."event_log"."uuid"`
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+
+	query, _ = GetUpdateQuery("analytics.event_log", map[string]interface{}{"uuid": "x", "name": "y"}, "uuid")
+	expected = `UPDATE "analytics"."event_log" SET "name" = $1 WHERE "analytics"."event_log"."uuid" = $2 RETURNING "analytics"."event_log"."uuid"`
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+}
+
+func TestSubqueryFilter(t *testing.T) {
+	group := &FilterGroup{
+		Filter: Filter{"Type": "test_type"},
+		Groups: []FilterGroup{{Filter: Filter{"UUID": Subquery{
+			Query: `SELECT ai_model_uuid FROM user_favorites WHERE user_uuid = $1 AND rank > $2`,
+			Args:  []interface{}{"user", 3},
+		}}}},
+	}
+
+	query, args, err := FilterGroupQuery("", "ai_model", group, nil, "ai_model", 10, 1)
+	if err != nil {
+		t.Fatalf("FilterGroupQuery error: %v", err)
+	}
+	expected := ` WHERE ("ai_model"."type" = $1 AND ("ai_model"."uuid" IN (SELECT ai_model_uuid FROM user_favorites WHERE user_uuid = $2 AND rank > $3))) LIMIT 10 OFFSET 0`
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+	if len(args) != 3 || args[1] != "user" || args[2] != 3 {
+		t.Errorf("Unexpected args: %v", args)
+	}
+}
+
+func TestPaginatedResultJSON(t *testing.T) {
+	data, err := json.Marshal(PaginatedResult[AIModelTest]{})
+	if err != nil {
+		t.Fatalf("Marshal error: %v", err)
+	}
+	if !strings.HasPrefix(string(data), `{"data":[],"pagination":`) {
+		t.Errorf("Expected empty data array, got %s", data)
+	}
+}
+
+func TestDeleteWhereReturning(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+
+	for i := 1; i <= 4; i++ {
+		aiModel := AIModelTest{
+			Key:      *octypes.NewNullString(fmt.Sprintf("key_%d", i)),
+			Type:     *octypes.NewNullString(fmt.Sprintf("type_%d", i%2)),
+			Provider: *octypes.NewNullString("test_provider"),
+		}
+		if err := aiModel.Insert(); err != nil {
+			t.Fatalf("Insert error: %v", err)
+		}
+	}
+
+	var deleted []struct {
+		UUID string `db:"uuid"`
+		Key  string `db:"key"`
+	}
+	err := DeleteWhereReturning(&deleted, "ai_model", &Filter{"Type": "type_0"}, "uuid", "key")
+	if err != nil {
+		t.Fatalf("DeleteWhereReturning error: %v", err)
+	}
+	if len(deleted) != 2 {
+		t.Errorf("Expected 2 deleted rows, got %d", len(deleted))
+	}
+
+	if _, err := DeleteWhere("ai_model", &Filter{}); err == nil {
+		t.Errorf("Expected error when deleting without conditions")
+	}
+}
+
+func TestBetweenFilter(t *testing.T) {
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	query, args, err := FilterQuery("", "realm", &Filter{"CreatedAt[$between]": []time.Time{from, to}}, nil, "realm", 10, 1)
+	if err != nil {
+		t.Fatalf("FilterQuery error: %v", err)
+	}
+	expected := ` WHERE "realm"."created_at" BETWEEN $1 AND $2 LIMIT 10 OFFSET 0`
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+	if len(args) != 2 || args[0] != from || args[1] != to {
+		t.Errorf("Unexpected args: %v", args)
+	}
+
+	if _, _, err := FilterQuery("", "realm", &Filter{"CreatedAt[$between]": from}, nil, "realm", 10, 1); err == nil {
+		t.Errorf("Expected error for a single $between value")
+	}
+}
+
+func TestDefaultQueryTimeout(t *testing.T) {
+	DefaultQueryTimeout = 50 * time.Millisecond
+	defer func() { DefaultQueryTimeout = 0 }()
+
+	_, err := ExecContext(context.Background(), `SELECT pg_sleep(1)`)
+	if err == nil {
+		t.Errorf("Expected the default timeout to cancel the query")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	DefaultQueryTimeout = time.Millisecond
+	if _, err := ExecContext(ctx, `SELECT pg_sleep(0.05)`); err != nil {
+		t.Errorf("Expected the caller deadline to take precedence, got %v", err)
+	}
+}
+
+func TestNullBytesJSON(t *testing.T) {
+	tests := []struct {
+		value    NullBytes
+		expected string
+	}{
+		{NullBytes{}, `null`},
+		{NullBytes{Bytes: []byte{}, Valid: true}, `""`},
+		{NullBytes{Bytes: []byte("thumb"), Valid: true}, `"dGh1bWI="`},
+	}
+
+	for _, test := range tests {
+		data, err := json.Marshal(test.value)
+		if err != nil {
+			t.Fatalf("Marshal error: %v", err)
+		}
+		if string(data) != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, data)
+		}
+
+		var decoded NullBytes
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("Unmarshal error: %v", err)
+		}
+		if decoded.Valid != test.value.Valid || string(decoded.Bytes) != string(test.value.Bytes) {
+			t.Errorf("Expected %v after round trip, got %v", test.value, decoded)
+		}
+	}
+}
+
+func TestGetUpsertQuery(t *testing.T) {
+	valuesMap := map[string]interface{}{"uuid": "x", "key": "k", "name": "n", "type": "t", "provider": "p"}
+
+	query, _, err := GetUpsertQuery("ai_model", valuesMap, ConflictConstraint("ai_model_key_active_uidx"), "uuid")
+	if err != nil {
+		t.Fatalf("GetUpsertQuery error: %v", err)
+	}
+	expected := ` ON CONFLICT ON CONSTRAINT "ai_model_key_active_uidx" DO UPDATE SET "key" = EXCLUDED."key", "name" = EXCLUDED."name", "type" = EXCLUDED."type", "provider" = EXCLUDED."provider" RETURNING "ai_model"."uuid"`
+	if !strings.HasSuffix(query, expected) {
+		t.Errorf("Expected suffix %q, got %q", expected, query)
+	}
+
+	query, _, err = GetUpsertQuery("ai_model", valuesMap, ConflictColumns("key"), "")
+	if err != nil {
+		t.Fatalf("GetUpsertQuery error: %v", err)
+	}
+	expected = ` ON CONFLICT ("key") DO UPDATE SET "name" = EXCLUDED."name", "type" = EXCLUDED."type", "provider" = EXCLUDED."provider"`
+	if !strings.HasSuffix(query, expected) {
+		t.Errorf("Expected suffix %q, got %q", expected, query)
+	}
+
+	query, _, err = GetUpsertQuery("ai_model", valuesMap, ConflictColumns("key").Where("deleted_at IS NULL"), "")
+	if err != nil {
+		t.Fatalf("GetUpsertQuery error: %v", err)
+	}
+	if !strings.Contains(query, ` ON CONFLICT ("key") WHERE deleted_at IS NULL DO UPDATE SET `) {
+		t.Errorf("Expected partial index predicate in %q", query)
+	}
+	if _, _, err := GetUpsertQuery("ai_model", valuesMap, ConflictConstraint("c").Where("x"), ""); err == nil {
+		t.Errorf("Expected error for a predicate on a constraint target")
+	}
+}
+
+func TestCastFilter(t *testing.T) {
+	query, _, err := FilterQuery("", "ai_model", &Filter{"Key::int[$gt]": 3}, nil, "ai_model", 10, 1)
+	if err != nil {
+		t.Fatalf("FilterQuery error: %v", err)
+	}
+	expected := ` WHERE ("ai_model"."key")::int > $1 LIMIT 10 OFFSET 0`
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+
+	if _, _, err := FilterQuery("", "ai_model", &Filter{"Key::text); DROP TABLE ai_model; --": 3}, nil, "ai_model", 10, 1); err == nil {
+		t.Errorf("Expected error for a cast outside the whitelist")
+	}
+}
+
+func TestPlanFilterQuery(t *testing.T) {
+	plan, err := PlanFilterQuery("ai_model", &Filter{"Type": "test_type"}, &Sort{"Key": "desc"}, "ai_model", 20, 3)
+	if err != nil {
+		t.Fatalf("PlanFilterQuery error: %v", err)
+	}
+
+	if len(plan.Conditions) != 1 || plan.Conditions[0] != `"ai_model"."type" = $1` {
+		t.Errorf("Unexpected conditions: %v", plan.Conditions)
+	}
+	if len(plan.OrderBy) != 1 || plan.OrderBy[0] != `"ai_model"."key" DESC` {
+		t.Errorf("Unexpected order by: %v", plan.OrderBy)
+	}
+	if plan.Limit != 20 || plan.Offset != 40 {
+		t.Errorf("Expected LIMIT 20 OFFSET 40, got LIMIT %d OFFSET %d", plan.Limit, plan.Offset)
+	}
+}
+
+func TestRegisterOperator(t *testing.T) {
+	err := RegisterOperator("$within", func(table, column string, argIndex int) (string, int) {
+		return fmt.Sprintf(`ST_DWithin(%s.%s, ST_MakePoint($%d, $%d), $%d)`, table, column, argIndex, argIndex+1, argIndex+2), 3
+	})
+	if err != nil {
+		t.Fatalf("RegisterOperator error: %v", err)
+	}
+	if err := RegisterOperator("$within", nil); err == nil {
+		t.Errorf("Expected error registering a duplicate operator")
+	}
+	if err := RegisterOperator("$gte", nil); err == nil {
+		t.Errorf("Expected error registering a built-in operator")
+	}
+
+	group := &FilterGroup{Filter: Filter{"Type": "test_type"}, Groups: []FilterGroup{{Filter: Filter{"Settings[$within]": []float64{2.35, 48.85, 1000}}}}}
+	query, args, err := FilterGroupQuery("", "ai_model", group, nil, "ai_model", 10, 1)
+	if err != nil {
+		t.Fatalf("FilterGroupQuery error: %v", err)
+	}
+	if !strings.Contains(query, `ST_DWithin("ai_model"."settings", ST_MakePoint($2, $3), $4)`) {
+		t.Errorf("Expected custom operator condition, got %q", query)
+	}
+	if len(args) != 4 || args[3] != float64(1000) {
+		t.Errorf("Unexpected args: %v", args)
+	}
+}
+
+func TestQueryBuilderClone(t *testing.T) {
+	base := SelectBase("website", "website").Left("realm", "r", "website.realm_uuid = r.uuid")
+	expected := base.Build()
+
+	clone := base.Clone()
+	clone.Joins[0].OnCondition = "true"
+	clone.Joins = append(clone.Joins, Join{Table: "realm", TableAlias: "r2", JoinType: "LEFT JOIN", OnCondition: "true"})
+	clone.Exprs = append(clone.Exprs, `1 AS "one"`)
+	clone.Coalesces["domain"] = "''"
+
+	if query := base.Build(); query != expected {
+		t.Errorf("Expected the original builder unchanged, got %q", query)
+	}
+	if len(base.Joins) != 1 || base.Joins[0].OnCondition != "website.realm_uuid = r.uuid" || len(base.Coalesces) != 0 {
+		t.Errorf("Expected the original state unchanged, got %+v", base)
+	}
+}
+
+func TestQueryBuilderImmutable(t *testing.T) {
+	base := SelectBase("website", "website")
+	withRealm := base.Left("realm", "r", "website.realm_uuid = r.uuid")
+
+	if len(base.Joins) != 0 {
+		t.Errorf("Expected base builder to be left untouched, got %d joins", len(base.Joins))
+	}
+	if len(withRealm.Joins) != 1 {
+		t.Errorf("Expected 1 join on the clone, got %d", len(withRealm.Joins))
+	}
+}
+
+func TestQueryBuilderConcurrentUse(t *testing.T) {
+	base := SelectBase("website", "website")
+	expected := base.Left("realm", "r", "website.realm_uuid = r.uuid").Build()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			query := base.Left("realm", "r", "website.realm_uuid = r.uuid").Build()
+			if query != expected {
+				t.Errorf("Expected %q, got %q", expected, query)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(base.Joins) != 0 {
+		t.Errorf("Expected shared base builder to stay without joins, got %d", len(base.Joins))
+	}
+}
+
+func TestGetByUUIDs(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+
+	uuids := []string{}
+	for i := 1; i <= 3; i++ {
+		aiModel := AIModelTest{
+			Key:      *octypes.NewNullString(fmt.Sprintf("key_%d", i)),
+			Type:     *octypes.NewNullString("test_type"),
+			Provider: *octypes.NewNullString("test_provider"),
+		}
+		if err := aiModel.Insert(); err != nil {
+			t.Fatalf("Insert error: %v", err)
+		}
+		uuids = append(uuids, aiModel.UUID.String)
+	}
+	missing := GenNewUUID("")
+	uuids = append(uuids, missing)
+
+	models, err := GetByUUIDs[AIModelTest]("ai_model", uuids)
+	if err != nil {
+		t.Fatalf("GetByUUIDs error: %v", err)
+	}
+	if len(models) != 4 {
+		t.Errorf("Expected 4 entries, got %d", len(models))
+	}
+	if models[missing] != nil {
+		t.Errorf("Expected nil for missing UUID")
+	}
+	if models[uuids[1]] == nil || models[uuids[1]].Key.String != "key_2" {
+		t.Errorf("Expected key_2 for %s, got %v", uuids[1], models[uuids[1]])
+	}
+}
+
+func TestFilterConditionsDeterministic(t *testing.T) {
+	filters := &Filter{"Type": "test_type", "Provider": "test_provider", "Key[$ne]": "key_1", "Name[$like]": "Model%"}
+	expected := ` WHERE "ai_model"."key" != $1 AND "ai_model"."name" LIKE $2 AND "ai_model"."provider" = $3 AND "ai_model"."type" = $4 LIMIT 10 OFFSET 0`
+
+	for i := 0; i < 20; i++ {
+		query, args, err := FilterQuery("", "ai_model", filters, nil, "ai_model", 10, 1)
+		if err != nil {
+			t.Fatalf("FilterQuery error: %v", err)
+		}
+		if query != expected {
+			t.Fatalf("Expected %q, got %q", expected, query)
+		}
+		if args[0] != "key_1" || args[3] != "test_type" {
+			t.Fatalf("Unexpected args order: %v", args)
+		}
+	}
+}
+
+func TestFindOne(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+
+	for i := 1; i <= 3; i++ {
+		aiModel := AIModelTest{
+			Key:      *octypes.NewNullString(fmt.Sprintf("key_%d", i)),
+			Type:     *octypes.NewNullString("test_type"),
+			Provider: *octypes.NewNullString("test_provider"),
+		}
+		if err := aiModel.Insert(); err != nil {
+			t.Fatalf("Insert error: %v", err)
+		}
+	}
+
+	model, err := FindOne[AIModelTest]("ai_model", "", &Filter{"Type": "test_type"}, &Sort{"Key": "DESC"})
+	if err != nil {
+		t.Fatalf("FindOne error: %v", err)
+	}
+	if model == nil || model.Key.String != "key_3" {
+		t.Errorf("Expected key_3, got %v", model)
+	}
+
+	model, err = FindOne[AIModelTest]("ai_model", "", &Filter{"Type": "missing"}, nil)
+	if err != nil || model != nil {
+		t.Errorf("Expected (nil, nil), got (%v, %v)", model, err)
+	}
+}
+
+func TestExistsAndGetByUUID(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+
+	aiModel := AIModelTest{
+		Key:      *octypes.NewNullString("exists_key"),
+		Type:     *octypes.NewNullString("test_type"),
+		Provider: *octypes.NewNullString("test_provider"),
+	}
+	if err := aiModel.Insert(); err != nil {
+		t.Fatalf("Insert error: %v", err)
+	}
+
+	exists, err := Exists("ai_model", &Filter{"Key": "exists_key"})
+	if err != nil || !exists {
+		t.Errorf("Expected a matching row, got %v (%v)", exists, err)
+	}
+	exists, err = ExistsContext(context.Background(), "ai_model", &Filter{"Key": "missing"})
+	if err != nil || exists {
+		t.Errorf("Expected no matching row, got %v (%v)", exists, err)
+	}
+
+	model, err := GetByUUID[AIModelTest]("ai_model", aiModel.UUID.String)
+	if err != nil || model == nil || model.Key.String != "exists_key" {
+		t.Errorf("Expected the inserted model, got %v (%v)", model, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := GetByUUIDContext[AIModelTest](ctx, "ai_model", aiModel.UUID.String); err == nil {
+		t.Errorf("Expected an error for a cancelled context")
+	}
+}
+
+func TestValidateReturning(t *testing.T) {
+	if _, _, err := GetUpdateQueryE("realm", map[string]interface{}{"name": "x", "uuidd": "y"}, "uuidd"); err == nil || !strings.Contains(err.Error(), "invalid returning column uuidd for table realm") {
+		t.Errorf("Expected invalid returning column error, got %v", err)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("Expected GetInsertQuery to panic on an invalid returning column")
+		}
+	}()
+	GetInsertQuery("realm", map[string]interface{}{"uuid": "x", "name": "y"}, "uuidd")
+}
+
+func TestWithDSNParam(t *testing.T) {
+	got := withDSNParam("host=localhost dbname=test_db", "search_path", "tenant a")
+	if got != `host=localhost dbname=test_db search_path='tenant a'` {
+		t.Errorf("Unexpected keyword/value DSN: %q", got)
+	}
+
+	got = withDSNParam("postgres://user@localhost/test_db?sslmode=disable", "search_path", "tenant_a")
+	if got != "postgres://user@localhost/test_db?search_path=tenant_a&sslmode=disable" {
+		t.Errorf("Unexpected URL DSN: %q", got)
+	}
+}
+
+func TestTenantScoping(t *testing.T) {
+	type TenantNoteTest struct {
+		UUID       string `db:"uuid" dbMode:"i"`
+		TenantUUID string `db:"tenant_uuid" dbMode:"i,tenant"`
+		Body       string `db:"body" dbMode:"i,u"`
+	}
+	InitModelTagCache(TenantNoteTest{}, "tenant_note")
+
+	if _, err := scopeFilters(context.Background(), "tenant_note", &Filter{"Body": "x"}); !errors.Is(err, ErrNoTenant) {
+		t.Errorf("Expected ErrNoTenant, got %v", err)
+	}
+
+	filters, err := scopeFilters(WithTenant(context.Background(), "tenant_a"), "tenant_note", &Filter{"Body": "x", "TenantUUID": "tenant_b"})
+	if err != nil {
+		t.Fatalf("scopeFilters error: %v", err)
+	}
+	if (*filters)["TenantUUID"] != "tenant_a" || (*filters)["Body"] != "x" {
+		t.Errorf("Unexpected scoped filters: %v", *filters)
+	}
+
+	filters, err = scopeFilters(WithoutTenant(context.Background()), "tenant_note", nil)
+	if err != nil || filters != nil {
+		t.Errorf("Expected bypass to leave filters untouched, got (%v, %v)", filters, err)
+	}
+}
+
+func TestTenantScopedWrites(t *testing.T) {
+	type TenantDocTest struct {
+		UUID       string `db:"uuid" dbMode:"i"`
+		TenantUUID string `db:"tenant_uuid" dbMode:"i,tenant"`
+		Body       string `db:"body" dbMode:"i,u"`
+	}
+	InitModelTagCache(TenantDocTest{}, "tenant_doc")
+	tenantA := WithTenant(context.Background(), "tenant_a")
+
+	if _, err := DeleteWhere("tenant_doc", &Filter{"Body": "x"}); !errors.Is(err, ErrNoTenant) {
+		t.Errorf("Expected ErrNoTenant from an unscoped delete, got %v", err)
+	}
+	if _, err := BulkUpdate("tenant_doc", "uuid", []map[string]interface{}{{"uuid": "u1", "body": "x"}}); !errors.Is(err, ErrNoTenant) {
+		t.Errorf("Expected ErrNoTenant from an unscoped bulk update, got %v", err)
+	}
+	if err := UpdateJSONField("tenant_doc", "body", []string{"a"}, 1, "uuid", "u1"); !errors.Is(err, ErrNoTenant) {
+		t.Errorf("Expected ErrNoTenant from an unscoped JSON update, got %v", err)
+	}
+
+	// Deleting another tenant's rows by filtering on its id still targets the context tenant
+	query, args, err := getDeleteWhereQuery(tenantA, "tenant_doc", &Filter{"TenantUUID": "tenant_b"})
+	if err != nil {
+		t.Fatalf("getDeleteWhereQuery error: %v", err)
+	}
+	if query != `DELETE FROM "tenant_doc" WHERE "tenant_doc"."tenant_uuid" = $1` || len(args) != 1 || args[0] != "tenant_a" {
+		t.Errorf("Expected a delete scoped to tenant_a, got %q with %v", query, args)
+	}
+	if _, _, err := getDeleteWhereQuery(tenantA, "tenant_doc", nil); err == nil {
+		t.Errorf("Expected the tenant condition alone to be refused")
+	}
+
+	query, args, err = getBulkUpdateQuery(tenantA, "tenant_doc", "uuid", []map[string]interface{}{{"uuid": "u1", "body": "x"}}, false)
+	if err != nil {
+		t.Fatalf("getBulkUpdateQuery error: %v", err)
+	}
+	if !strings.HasSuffix(query, `WHERE "tenant_doc"."uuid" = v."uuid" AND "tenant_doc"."tenant_uuid" = $3`) || args[2] != "tenant_a" {
+		t.Errorf("Expected a bulk update scoped to tenant_a, got %q with %v", query, args)
+	}
+
+	query, args, err = getUpdateJSONFieldQuery(tenantA, "tenant_doc", "body", []string{"a"}, 1, "uuid", "u1")
+	if err != nil {
+		t.Fatalf("getUpdateJSONFieldQuery error: %v", err)
+	}
+	if !strings.HasSuffix(query, `= $2 AND "tenant_doc"."tenant_uuid" = $3`) || args[2] != "tenant_a" {
+		t.Errorf("Expected a JSON update scoped to tenant_a, got %q with %v", query, args)
+	}
+}
+
+func TestScanInto(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+
+	aiModel := AIModelTest{
+		Key:      *octypes.NewNullString("key_1"),
+		Type:     *octypes.NewNullString("test_type"),
+		Provider: *octypes.NewNullString("test_provider"),
+	}
+	if err := aiModel.Insert(); err != nil {
+		t.Fatalf("Insert error: %v", err)
+	}
+	if _, err := Db.Exec(`UPDATE ai_model SET provider = 'new_provider' WHERE uuid = $1`, aiModel.UUID); err != nil {
+		t.Fatalf("Update error: %v", err)
+	}
+
+	aiModel.Description = *octypes.NewNullString("in-memory only")
+	err := ScanInto(&aiModel, `SELECT provider FROM ai_model WHERE uuid = $1`, aiModel.UUID)
+	if err != nil {
+		t.Fatalf("ScanInto error: %v", err)
+	}
+	if aiModel.Provider.String != "new_provider" {
+		t.Errorf("Expected refreshed provider, got %s", aiModel.Provider.String)
+	}
+	if aiModel.Description.String != "in-memory only" || aiModel.Key.String != "key_1" {
+		t.Errorf("Expected unselected fields to be left intact, got %+v", aiModel)
+	}
+}
+
+func TestArrayLenFilter(t *testing.T) {
+	query, _, err := FilterQuery("", "ai_model", &Filter{"Settings[$arraylen:$gt]": 2}, nil, "ai_model", 10, 1)
+	if err != nil {
+		t.Fatalf("FilterQuery error: %v", err)
+	}
+	expected := ` WHERE COALESCE(array_length("ai_model"."settings", 1), 0) > $1 LIMIT 10 OFFSET 0`
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+
+	query, _, err = FilterQuery("", "ai_model", &Filter{"Settings[$arraylen]": 0}, nil, "ai_model", 10, 1)
+	if err != nil {
+		t.Fatalf("FilterQuery error: %v", err)
+	}
+	expected = ` WHERE COALESCE(array_length("ai_model"."settings", 1), 0) = $1 LIMIT 10 OFFSET 0`
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+
+	if _, _, err := FilterQuery("", "ai_model", &Filter{"Settings[$arraylen:$like]": 0}, nil, "ai_model", 10, 1); err == nil {
+		t.Errorf("Expected error for an invalid $arraylen comparison")
+	}
+}
+
+func TestValuesCTE(t *testing.T) {
+	qb := SelectBase("ai_model", "").
+		WithValues("lookup", []string{"provider", "label"}, [][]interface{}{{"openai", "OpenAI"}, {"mistral", "Mistral AI"}}).
+		LeftCTE("lookup", "l", `l.provider = "ai_model"."provider"`)
+
+	query, args, err := qb.FilterQuery(&Filter{"Type": "test_type"}, nil, 10, 1)
+	if err != nil {
+		t.Fatalf("FilterQuery error: %v", err)
+	}
+
+	if !strings.HasPrefix(query, `WITH "lookup"("provider","label") AS (VALUES ($1,$2),($3,$4)) SELECT `) {
+		t.Errorf("Unexpected CTE in %q", query)
+	}
+	if !strings.Contains(query, `"l"."label" AS "l.label"`) || !strings.Contains(query, `LEFT JOIN "lookup" AS l ON l.provider = "ai_model"."provider"`) {
+		t.Errorf("Unexpected join in %q", query)
+	}
+	if !strings.HasSuffix(query, `WHERE "ai_model"."type" = $5 LIMIT 10 OFFSET 0`) {
+		t.Errorf("Expected filter placeholder after the CTE args in %q", query)
+	}
+	if len(args) != 5 || args[3] != "Mistral AI" || args[4] != "test_type" {
+		t.Errorf("Unexpected args: %v", args)
+	}
+}
+
+func TestValuesCTETypes(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+	realmUUID := GenNewUUID("")
+	query, args := GetInsertQuery("realm", map[string]interface{}{"uuid": realmUUID, "name": "typed"}, "")
+	if _, err := Db.Exec(query, args...); err != nil {
+		t.Fatalf("Insert error: %v", err)
+	}
+
+	qb := SelectBase("realm", "").
+		WithValues("lookup", []string{"uuid::uuid", "rank::int"}, [][]interface{}{{realmUUID, 1}}).
+		LeftCTE("lookup", "l", `l.uuid = "realm"."uuid"`).
+		SelectExpr("l.rank + 1", "next_rank")
+	query, args = qb.BuildWithArgs()
+	if !strings.HasPrefix(query, `WITH "lookup"("uuid","rank") AS (VALUES ($1::uuid,$2::int)) SELECT `) {
+		t.Errorf("Expected typed placeholders in %q", query)
+	}
+
+	var row struct {
+		RealmTest
+		NextRank int `db:"next_rank"`
+	}
+	if err := Db.Unsafe().Get(&row, query, args...); err != nil {
+		t.Fatalf("Query joining on a uuid column failed: %v", err)
+	}
+	if row.UUID != realmUUID || row.NextRank != 2 {
+		t.Errorf("Unexpected row %+v", row)
+	}
+}
+
+func TestGetInsertQueryReturning(t *testing.T) {
+	query, _, err := GetInsertQueryReturning("ai_model", map[string]interface{}{"uuid": "u1", "key": "k", "type": "t", "provider": "p"},
+		[]string{"uuid", "key"}, ReturningExpr{Expr: "length(key) * 2", Alias: "key_len"})
+	if err != nil {
+		t.Fatalf("GetInsertQueryReturning error: %v", err)
+	}
+	if !strings.HasSuffix(query, ` RETURNING "ai_model"."uuid", "ai_model"."key", length(key) * 2 AS "key_len"`) {
+		t.Errorf("Unexpected returning clause in %q", query)
+	}
+
+	if _, _, err := GetInsertQueryReturning("ai_model", map[string]interface{}{}, []string{"missing"}); err == nil {
+		t.Errorf("Expected error for invalid returning column")
+	}
+	if _, _, err := GetInsertQueryReturning("ai_model", map[string]interface{}{}, nil, ReturningExpr{Expr: "1"}); err == nil {
+		t.Errorf("Expected error for returning expression without alias")
+	}
+}
+
+func TestPreparedStatementCache(t *testing.T) {
+	defer func(max int) {
+		MaxCachedStatements = max
+		ClearStatementCache()
+	}(MaxCachedStatements)
+	MaxCachedStatements = 2
+	ClearStatementCache()
+
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		var n int
+		if err := PreparedGetContext(ctx, &n, fmt.Sprintf("SELECT %d + $1::int", i), 1); err != nil {
+			t.Fatalf("PreparedGetContext error: %v", err)
+		}
+		if n != i+1 {
+			t.Errorf("Expected %d, got %d", i+1, n)
+		}
+	}
+	if stmtLRU.Len() != 2 {
+		t.Errorf("Expected 2 cached statements after eviction, got %d", stmtLRU.Len())
+	}
+
+	var models []AIModelTest
+	if err := PreparedSelectContext(ctx, &models, aiModelBaseQuery); err != nil {
+		t.Fatalf("PreparedSelectContext error: %v", err)
+	}
+	if _, ok := stmtCache.Get(stmtKey(aiModelBaseQuery)); !ok {
+		t.Errorf("Expected base query to be cached")
+	}
+}
+
+func TestIterateCancel(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+	for i := 1; i <= 5; i++ {
+		aiModel := AIModelTest{
+			Key:      *octypes.NewNullString(fmt.Sprintf("key_%d", i)),
+			Type:     *octypes.NewNullString("test_type"),
+			Provider: *octypes.NewNullString("test_provider"),
+		}
+		if err := aiModel.Insert(); err != nil {
+			t.Fatalf("Insert error: %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	seen := 0
+	err := IterateContext[AIModelTest](ctx, func(m *AIModelTest) error {
+		seen++
+		if seen == 2 {
+			cancel()
+		}
+		return nil
+	}, aiModelBaseQuery)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	if seen != 2 {
+		t.Errorf("Expected iteration to stop after 2 rows, got %d", seen)
+	}
+	if inUse := Db.Stats().InUse; inUse != 0 {
+		t.Errorf("Expected no connection in use after cancellation, got %d", inUse)
+	}
+
+	seen = 0
+	if err := Iterate[AIModelTest](func(m *AIModelTest) error { seen++; return nil }, aiModelBaseQuery); err != nil {
+		t.Fatalf("Iterate error: %v", err)
+	}
+	if seen != 5 {
+		t.Errorf("Expected 5 rows, got %d", seen)
+	}
+}
+
+func TestCoalesceColumn(t *testing.T) {
+	base := SelectBase("ai_model", "")
+	qb := base.CoalesceColumn("Description", "").CoalesceColumn("Name", "it's")
+
+	query := qb.Build()
+	if !strings.Contains(query, `COALESCE("ai_model"."description", '') AS "description"`) {
+		t.Errorf("Expected coalesced description in %q", query)
+	}
+	if !strings.Contains(query, `COALESCE("ai_model"."name", 'it''s') AS "name"`) {
+		t.Errorf("Expected escaped default in %q", query)
+	}
+	if strings.Contains(base.Build(), "COALESCE") {
+		t.Errorf("CoalesceColumn modified the base builder")
+	}
+}
+
+func TestLoadChildren(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+	initRealmModel()
+	initWebsiteModel()
+
+	realms := []RealmTest{{UUID: GenNewUUID(""), Name: "with sites"}, {UUID: GenNewUUID(""), Name: "empty"}}
+	for _, realm := range realms {
+		query, args := GetInsertQuery("realm", map[string]interface{}{"uuid": realm.UUID, "name": realm.Name}, "")
+		if _, err := Db.Exec(query, args...); err != nil {
+			t.Fatalf("Failed to insert realm: %v", err)
+		}
+	}
+	for _, domain := range []string{"a.example.com", "b.example.com"} {
+		query, args := GetInsertQuery("website", map[string]interface{}{
+			"uuid":       GenNewUUID(""),
+			"domain":     domain,
+			"realm_uuid": realms[0].UUID,
+		}, "")
+		if _, err := Db.Exec(query, args...); err != nil {
+			t.Fatalf("Failed to insert website: %v", err)
+		}
+	}
+
+	sites := map[string][]WebsiteTest{}
+	err := LoadChildren(realms, func(r RealmTest) string { return r.UUID }, "website", "realm_uuid",
+		func(r *RealmTest, children []WebsiteTest) { sites[r.UUID] = children })
+	if err != nil {
+		t.Fatalf("LoadChildren error: %v", err)
+	}
+	if len(sites[realms[0].UUID]) != 2 {
+		t.Errorf("Expected 2 websites for first realm, got %d", len(sites[realms[0].UUID]))
+	}
+	if children, ok := sites[realms[1].UUID]; !ok || len(children) != 0 {
+		t.Errorf("Expected assign with no websites for second realm, got %v", children)
+	}
+}
+
+func TestDefaultNullsOrder(t *testing.T) {
+	defer func(nulls string) { DefaultNullsOrder = nulls }(DefaultNullsOrder)
+
+	orderBy, err := buildOrderBy("ai_model", &Sort{"Name": "desc"}, "ai_model")
+	if err != nil || orderBy[0] != `"ai_model"."name" DESC` {
+		t.Errorf("Unexpected order by %v (%v)", orderBy, err)
+	}
+
+	DefaultNullsOrder = "NULLS LAST"
+	orderBy, _ = buildOrderBy("ai_model", &Sort{"Name": "desc"}, "ai_model")
+	if orderBy[0] != `"ai_model"."name" DESC NULLS LAST` {
+		t.Errorf("Expected default nulls order, got %v", orderBy)
+	}
+	orderBy, _ = buildOrderBy("ai_model", &Sort{"Name": "asc nulls first"}, "ai_model")
+	if orderBy[0] != `"ai_model"."name" ASC NULLS FIRST` {
+		t.Errorf("Expected per-field override, got %v", orderBy)
+	}
+
+	if _, err := buildOrderBy("ai_model", &Sort{"Name": "ASC NULLS"}, "ai_model"); err == nil {
+		t.Errorf("Expected error for invalid nulls directive")
+	}
+}
+
+func TestJoinRaw(t *testing.T) {
+	qb := SelectBase("ai_model", "").
+		WithValues("lookup", []string{"provider"}, [][]interface{}{{"openai"}}).
+		JoinRaw(`LEFT JOIN LATERAL (SELECT count(*) AS n FROM ai_model m WHERE m.provider = "ai_model"."provider" AND m.type <> $1) AS same ON true`, "hidden").
+		SelectExpr("same.n", "same_provider_count")
+
+	query, args, err := qb.FilterQuery(&Filter{"Type": "test_type"}, nil, 10, 1)
+	if err != nil {
+		t.Fatalf("FilterQuery error: %v", err)
+	}
+	if !strings.Contains(query, `m.type <> $2) AS same ON true`) {
+		t.Errorf("Expected raw join placeholder after the CTE args in %q", query)
+	}
+	if !strings.Contains(query, `same.n AS "same_provider_count"`) || !strings.Contains(query, `"ai_model"."type" = $3`) {
+		t.Errorf("Unexpected query %q", query)
+	}
+	if len(args) != 3 || args[1] != "hidden" || args[2] != "test_type" {
+		t.Errorf("Unexpected args: %v", args)
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	defer func(logger func(QueryEvent), rate int64) {
+		QueryLogger = logger
+		LogSampleRate = rate
+	}(QueryLogger, LogSampleRate)
+
+	if got := normalizeQuery("SELECT * FROM t WHERE a = 'x''y' AND b = $2\n LIMIT 10"); got != "SELECT * FROM t WHERE a = ? AND b = $? LIMIT ?" {
+		t.Errorf("Unexpected normalized query %q", got)
+	}
+
+	var events []QueryEvent
+	QueryLogger = func(e QueryEvent) { events = append(events, e) }
+	LogSampleRate = 3
+
+	failure := errors.New("boom")
+	for i := 0; i < 7; i++ {
+		logQuery(context.Background(), fmt.Sprintf("SELECT broken LIMIT %d", i), nil, time.Now(), 0, failure)
+	}
+	logQuery(context.Background(), "SELECT ok", nil, time.Now(), 1, nil)
+	logQuery(context.Background(), "SELECT missing", nil, time.Now(), 0, sql.ErrNoRows)
+
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 sampled events, got %d", len(events))
+	}
+	if events[2].Occurrences != 7 || events[2].Err != failure {
+		t.Errorf("Unexpected last event: %+v", events[2])
+	}
+}
+
+func TestLogSamplingBounded(t *testing.T) {
+	defer func(logger func(QueryEvent), shapes int) {
+		QueryLogger = logger
+		maxQueryEventShapes = shapes
+	}(QueryLogger, maxQueryEventShapes)
+
+	QueryLogger = func(QueryEvent) {}
+	maxQueryEventShapes = 3
+	for i := 0; i < 10; i++ {
+		logSampled("test", QueryEvent{Query: fmt.Sprintf("SELECT * FROM shape_%d", i)})
+	}
+
+	queryEventMu.Lock()
+	defer queryEventMu.Unlock()
+	if len(queryEventCounts) > 3 {
+		t.Errorf("Expected at most 3 counted shapes, got %d", len(queryEventCounts))
+	}
+}
+
+func TestGetInsertQueryOmitMissing(t *testing.T) {
+	values := map[string]interface{}{"uuid": "u1", "key": "k"}
+
+	query, args := GetInsertQuery("ai_model", values, "")
+	if !strings.HasPrefix(query, `INSERT INTO "ai_model" ("uuid","key","name","description","type","provider","settings","default_negative_prompt") VALUES ($1,$2,NULL,NULL,DEFAULT,DEFAULT,NULL,NULL)`) {
+		t.Errorf("Unexpected insert query %q", query)
+	}
+
+	query, args = GetInsertQueryOmitMissing("ai_model", values, "")
+	if query != `INSERT INTO "ai_model" ("uuid","key","name","description","settings","default_negative_prompt") VALUES ($1,$2,NULL,NULL,NULL,NULL)` {
+		t.Errorf("Unexpected insert query %q", query)
+	}
+	if len(args) != 2 {
+		t.Errorf("Expected 2 args, got %v", args)
+	}
+}
+
+func TestGetInsertQuerySkipNull(t *testing.T) {
+	values := map[string]interface{}{"uuid": "u1", "key": "k", "type": octypes.NullString{}, "name": octypes.NullString{}}
+
+	query, args := GetInsertQuerySkipNull("ai_model", values, "")
+	if !strings.HasPrefix(query, `INSERT INTO "ai_model" ("uuid","key","name","description","type","provider","settings","default_negative_prompt") VALUES ($1,$2,NULL,NULL,DEFAULT,DEFAULT,NULL,NULL)`) {
+		t.Errorf("Unexpected insert query %q", query)
+	}
+	if len(args) != 2 {
+		t.Errorf("Expected 2 args, got %v", args)
+	}
+}
+
+func TestFilterFromQuery(t *testing.T) {
+	allowed := map[string]string{"type": "Type", "provider": "Provider", "name": "Name"}
+	values := url.Values{
+		"type":          {"text"},
+		"provider[$in]": {"openai,anthropic", "local"},
+		"name[$prefix]": {"gpt"},
+		"sort":          {"name,type:desc"},
+		"order":         {"asc"},
+		"page":          {"2"},
+	}
+
+	filters, sort, err := FilterFromQuery(values, allowed)
+	if err != nil {
+		t.Fatalf("FilterFromQuery error: %v", err)
+	}
+	if (*filters)["Type"] != "text" || (*filters)["Name[$prefix]"] != "gpt" || len((*filters)["Provider[$in]"].([]string)) != 3 {
+		t.Errorf("Unexpected filters %v", *filters)
+	}
+	if sort == nil || (*sort)["Name"] != "ASC" || (*sort)["Type"] != "DESC" {
+		t.Errorf("Unexpected sort %v", sort)
+	}
+
+	for _, bad := range []url.Values{
+		{"settings": {"x"}},
+		{"type[$bogus]": {"x"}},
+		{"type": {"a", "b"}},
+		{"sort": {"settings"}},
+	} {
+		if _, _, err := FilterFromQuery(bad, allowed); err == nil {
+			t.Errorf("Expected an error for %v", bad)
+		}
+	}
+}
+
+func TestValuerSliceFilter(t *testing.T) {
+	keys := []octypes.NullString{*octypes.NewNullString("a"), *octypes.NewNullString("b"), {}}
+	conditions, args, err := constructConditions("ai_model", &Filter{"Key[$in]": keys}, "ai_model")
+	if err != nil {
+		t.Fatalf("constructConditions error: %v", err)
+	}
+	if len(conditions) != 1 || len(args) != 1 {
+		t.Fatalf("Unexpected conditions %v with %v", conditions, args)
+	}
+	value, err := args[0].(driver.Valuer).Value()
+	if err != nil || value != `{"a","b",NULL}` {
+		t.Errorf("Unexpected array value %v, %v", value, err)
+	}
+}
+
+func TestSafeOrderBy(t *testing.T) {
+	allowed := map[string]string{"name": `"ai_model"."name"`, "created": `"ai_model"."created_at"`}
+
+	orderBy, err := SafeOrderBy("name:desc, created", allowed)
+	if err != nil {
+		t.Fatalf("SafeOrderBy error: %v", err)
+	}
+	if orderBy != `"ai_model"."name" DESC, "ai_model"."created_at" ASC` {
+		t.Errorf("Unexpected order by %q", orderBy)
+	}
+
+	if _, err := SafeOrderBy("name; DROP TABLE ai_model", allowed); err == nil {
+		t.Errorf("Expected error for unknown field")
+	}
+	if _, err := SafeOrderBy("name:sideways", allowed); err == nil {
+		t.Errorf("Expected error for invalid direction")
+	}
+	if orderBy, err := SafeOrderBy("", allowed); err != nil || orderBy != "" {
+		t.Errorf("Expected empty order by, got %q (%v)", orderBy, err)
+	}
+}
+
+func TestGetTruncateQuery(t *testing.T) {
+	query, err := getTruncateQuery(TruncateOptions{RestartIdentity: true, Cascade: true}, "ai_model", "website")
+	if err != nil {
+		t.Fatalf("getTruncateQuery error: %v", err)
+	}
+	if query != `TRUNCATE TABLE "ai_model", "website" RESTART IDENTITY CASCADE` {
+		t.Errorf("Unexpected truncate query %q", query)
+	}
+
+	if err := Truncate("pg_authid"); err == nil {
+		t.Errorf("Expected error for unregistered table")
+	}
+}
+
+func TestBulkUpdateReturningQuery(t *testing.T) {
+	rows := []map[string]interface{}{{"uuid": "a", "name": "x"}, {"uuid": "b", "name": "y"}}
+	query, args, err := getBulkUpdateReturningQuery(context.Background(), "ai_model", "uuid", rows, []string{"uuid", "name"})
+	if err != nil {
+		t.Fatalf("getBulkUpdateReturningQuery error: %v", err)
+	}
+	expected := `WITH "updated" AS (UPDATE "ai_model" SET "name" = v."name" FROM (SELECT "uuid","name",0 FROM "ai_model" WHERE false UNION ALL VALUES ($1,$2,1),($3,$4,2)) AS v("uuid","name","ordinal") WHERE "ai_model"."uuid" = v."uuid" RETURNING "ai_model"."uuid", "ai_model"."name", v."ordinal" AS "ordinal") SELECT "uuid", "name" FROM "updated" ORDER BY "ordinal"`
+	if query != expected || len(args) != 4 {
+		t.Errorf("Expected %q, got %q with %v", expected, query, args)
+	}
+
+	if _, _, err := getBulkUpdateReturningQuery(context.Background(), "ai_model", "uuid", rows, nil); err == nil {
+		t.Errorf("Expected error for empty returning columns")
+	}
+}
+
+func TestFilterQueryNonEmpty(t *testing.T) {
+	var noTags []string
+	filters := &Filter{"Name": "", "Key[$in]": noTags, "Provider": nil, "Type": "test_type"}
+
+	query, args, err := FilterQueryNonEmpty(aiModelBaseQuery, "ai_model", filters, nil, "ai_model", 10, 1)
+	if err != nil {
+		t.Fatalf("FilterQueryNonEmpty error: %v", err)
+	}
+	if !strings.HasSuffix(query, `WHERE "ai_model"."type" = $1 LIMIT 10 OFFSET 0`) || len(args) != 1 {
+		t.Errorf("Expected only the type condition, got %q %v", query, args)
+	}
+
+	query, _, _ = FilterQuery(aiModelBaseQuery, "ai_model", filters, nil, "ai_model", 10, 1)
+	if !strings.Contains(query, `"ai_model"."name" = $`) {
+		t.Errorf("Expected FilterQuery to keep explicit empty-string matching, got %q", query)
+	}
+}
+
+func TestFieldString(t *testing.T) {
+	key, err := fieldString(reflect.ValueOf(octypes.NullString{}))
+	if err != nil || key != "" {
+		t.Errorf("Expected empty key for a null Valuer, got %q (%v)", key, err)
+	}
+	key, err = fieldString(reflect.ValueOf(*octypes.NewNullString("uuid")))
+	if err != nil || key != "uuid" {
+		t.Errorf("Expected uuid, got %q (%v)", key, err)
+	}
+}
+
+func TestDecodeMapValue(t *testing.T) {
+	decoded, err := decodeMapValue("JSONB", []byte(`{"a":[1,2]}`))
+	if err != nil {
+		t.Fatalf("decodeMapValue error: %v", err)
+	}
+	if m, ok := decoded.(map[string]interface{}); !ok || len(m["a"].([]interface{})) != 2 {
+		t.Errorf("Unexpected decoded JSON %#v", decoded)
+	}
+
+	decoded, _ = decodeMapValue("_TEXT", []byte(`{a,"b c"}`))
+	if tags, ok := decoded.(pq.StringArray); !ok || len(tags) != 2 || tags[1] != "b c" {
+		t.Errorf("Unexpected decoded array %#v", decoded)
+	}
+
+	if decoded, _ := decodeMapValue("INT8", int64(3)); decoded != int64(3) {
+		t.Errorf("Expected scalar values to pass through, got %#v", decoded)
+	}
+}
+
+func TestInsertReturningMap(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+
+	row, err := InsertReturningMap("ai_model", map[string]interface{}{
+		"uuid":     GenNewUUID(""),
+		"key":      "map_key",
+		"type":     "test_type",
+		"provider": "test_provider",
+	})
+	if err != nil {
+		t.Fatalf("InsertReturningMap error: %v", err)
+	}
+	if row["key"] != "map_key" || row["name"] != nil {
+		t.Errorf("Unexpected returned row %v", row)
+	}
+}
+
+func TestNamedExecAndGet(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+
+	model := AIModelTest{
+		UUID:     *octypes.NewNullString(GenNewUUID("")),
+		Key:      *octypes.NewNullString("named_key"),
+		Type:     *octypes.NewNullString("test_type"),
+		Provider: *octypes.NewNullString("test_provider"),
+	}
+	if _, err := NamedExec(`INSERT INTO ai_model (uuid, key, type, provider) VALUES (:uuid, :key, :type, :provider)`, model); err != nil {
+		t.Fatalf("NamedExec error: %v", err)
+	}
+
+	found, err := NamedGet[AIModelTest](`SELECT * FROM ai_model WHERE key = :key`, map[string]interface{}{"key": "named_key"})
+	if err != nil {
+		t.Fatalf("NamedGet error: %v", err)
+	}
+	if found == nil || found.UUID.String != model.UUID.String {
+		t.Errorf("Expected the inserted model, got %+v", found)
+	}
+
+	missing, err := NamedGet[AIModelTest](`SELECT * FROM ai_model WHERE key = :key`, map[string]interface{}{"key": "missing"})
+	if err != nil || missing != nil {
+		t.Errorf("Expected (nil, nil) for no rows, got %+v, %v", missing, err)
+	}
+}
+
+func TestDateRange(t *testing.T) {
+	from := time.Date(2024, 3, 1, 15, 30, 0, 0, time.UTC)
+	to := time.Date(2024, 3, 31, 8, 0, 0, 0, time.UTC)
+
+	filters := Filter{"Type": "test_type"}.Merge(DateRange("CreatedAt", from, to))
+	if filters["CreatedAt[$gte]"] != time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC) {
+		t.Errorf("Unexpected lower bound %v", filters["CreatedAt[$gte]"])
+	}
+	if filters["CreatedAt[$lt]"] != time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC) {
+		t.Errorf("Unexpected upper bound %v", filters["CreatedAt[$lt]"])
+	}
+
+	conditions, _, err := constructConditions("website", &filters, "website")
+	if err != nil {
+		t.Fatalf("constructConditions error: %v", err)
+	}
+	if len(conditions) != 2 || conditions[1] != `"website"."created_at" < $2` {
+		t.Errorf("Unexpected conditions %v", conditions)
+	}
+}
+
+func TestInsertColumnOrder(t *testing.T) {
+	_, fields := GetInsertFields("website")
+	if strings.Join(fields, ",") != "uuid,created_at,updated_at,domain,realm_uuid" {
+		t.Errorf("Expected declaration order, got %v", fields)
+	}
+
+	for i := 0; i < 10; i++ {
+		query, _ := GetInsertQuery("website", map[string]interface{}{"realm_uuid": "r", "domain": "d", "uuid": "u"}, "")
+		if query != `INSERT INTO "website" ("uuid","created_at","updated_at","domain","realm_uuid") VALUES ($1,NOW(),NOW(),$2,$3)` {
+			t.Fatalf("Unexpected insert query %q", query)
+		}
+	}
+}
+
+func TestEnrichScanError(t *testing.T) {
+	scanErr := errors.New("missing destination name price in *[]fsql.AIModelTest")
+
+	var models []AIModelTest
+	err := enrichScanError(&models, scanErr)
+	if !errors.Is(err, scanErr) {
+		t.Errorf("Expected wrapped sqlx error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "column price") || !strings.Contains(err.Error(), "table ai_model maps uuid, key, name") {
+		t.Errorf("Unexpected enriched error %q", err)
+	}
+
+	other := errors.New("connection refused")
+	if enrichScanError(&models, other) != other {
+		t.Errorf("Expected unrelated errors to pass through")
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+
+	uuid := GenNewUUID("")
+	var row struct {
+		UUID string `db:"uuid"`
+		Name string `db:"name"`
+	}
+	for i, name := range []string{"first", "second"} {
+		valuesMap := map[string]interface{}{"uuid": uuid, "key": "k", "name": name, "type": "t", "provider": "p"}
+		inserted, err := Upsert("ai_model", valuesMap, ConflictColumns("uuid"), []string{"uuid", "name"}, &row)
+		if err != nil {
+			t.Fatalf("Upsert error: %v", err)
+		}
+		if inserted != (i == 0) {
+			t.Errorf("Upsert %d: expected inserted=%v, got %v", i, i == 0, inserted)
+		}
+		if row.UUID != uuid || row.Name != name {
+			t.Errorf("Upsert %d: unexpected returned row %+v", i, row)
+		}
+	}
+
+	if _, err := Upsert("ai_model", map[string]interface{}{"uuid": uuid}, ConflictColumns("uuid"), []string{"uuid"}, &row); err == nil {
+		t.Errorf("Expected error for upsert without update fields")
+	}
+}
+
+func TestWithCTE(t *testing.T) {
+	qb := SelectBase("ai_model", "").
+		WithValues("names", []string{"key"}, [][]interface{}{{"k1"}}).
+		With("filtered", SelectBase("ai_model", "").JoinRaw(`JOIN "names" ON "names"."key" = "ai_model"."key" AND "ai_model"."type" <> $1`, "hidden")).
+		From("filtered")
+
+	query, args, err := qb.FilterQuery(&Filter{"Provider": "openai"}, nil, 10, 1)
+	if err != nil {
+		t.Fatalf("FilterQuery error: %v", err)
+	}
+	if !strings.HasPrefix(query, `WITH "names"("key") AS (VALUES ($1)), "filtered" AS (SELECT `) {
+		t.Errorf("Unexpected CTEs in %q", query)
+	}
+	if !strings.Contains(query, `"ai_model"."type" <> $2 ) SELECT `) || !strings.Contains(query, `FROM "filtered" AS "ai_model"`) {
+		t.Errorf("Unexpected query %q", query)
+	}
+	if !strings.HasSuffix(query, `WHERE "ai_model"."provider" = $3 LIMIT 10 OFFSET 0`) {
+		t.Errorf("Expected main query placeholder after the CTE args in %q", query)
+	}
+	if len(args) != 3 || args[0] != "k1" || args[1] != "hidden" || args[2] != "openai" {
+		t.Errorf("Unexpected args: %v", args)
+	}
+}
+
+func TestMoney(t *testing.T) {
+	cases := map[string]Money{
+		"$1,234.56":     123456,
+		"-$1,234.56":    -123456,
+		"($12.30)":      -1230,
+		"$0.05":         5,
+		"$1,000,000.00": 100000000,
+	}
+	for input, expected := range cases {
+		var m Money
+		if err := m.Scan([]byte(input)); err != nil {
+			t.Errorf("Scan(%q) error: %v", input, err)
+		} else if m != expected {
+			t.Errorf("Scan(%q): expected %d, got %d", input, expected, m)
+		}
+	}
+
+	var m Money
+	if err := m.Scan("not money"); err == nil {
+		t.Errorf("Expected error for invalid money value")
+	}
+
+	if value, _ := Money(-123456).Value(); value != "-1234.56" {
+		t.Errorf("Unexpected value %v", value)
+	}
+	if data, _ := json.Marshal(Money(1230)); string(data) != "1230" {
+		t.Errorf("Unexpected JSON %s", data)
+	}
+}
+
+func TestSelectWhereIn(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		aiModel := AIModelTest{
+			Key:      *octypes.NewNullString(fmt.Sprintf("key_%d", i)),
+			Type:     *octypes.NewNullString("test_type"),
+			Provider: *octypes.NewNullString("test_provider"),
+		}
+		if err := aiModel.Insert(); err != nil {
+			t.Fatalf("Insert error: %v", err)
+		}
+	}
+
+	models, err := SelectWhereIn[AIModelTest]("ai_model", "", "key", []string{"key_1", "key_3", "missing"})
+	if err != nil {
+		t.Fatalf("SelectWhereIn error: %v", err)
+	}
+	if len(models) != 2 {
+		t.Errorf("Expected 2 models, got %d", len(models))
+	}
+
+	if _, err := SelectWhereIn[AIModelTest]("ai_model", "", "key; DROP TABLE ai_model", []string{"x"}); err == nil {
+		t.Errorf("Expected error for unknown column")
+	}
+}
+
+type upsertNullsTest struct {
+	UUID   string             `db:"uuid" dbMode:"i"`
+	Key    octypes.NullString `db:"key" dbMode:"i,u"`
+	Region octypes.NullString `db:"region" dbMode:"i,u"`
+	Name   string             `db:"name" dbMode:"i,u"`
+}
+
+func TestInsertOrResolve(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+
+	uuid := GenNewUUID("")
+	resolutions := map[string]ConflictResolution{
+		"ai_model_pkey": {Columns: []string{"uuid"}, Action: ConflictUpdate},
+	}
+	for i, name := range []string{"first", "second"} {
+		valuesMap := map[string]interface{}{"uuid": uuid, "key": "k", "name": name, "type": "t", "provider": "p"}
+		var returned string
+		created, err := InsertOrResolve("ai_model", valuesMap, resolutions, "name", &returned)
+		if err != nil {
+			t.Fatalf("InsertOrResolve error: %v", err)
+		}
+		if created != (i == 0) || returned != name {
+			t.Errorf("InsertOrResolve %d: expected created=%v and name %s, got %v and %s", i, i == 0, name, created, returned)
+		}
+	}
+
+	valuesMap := map[string]interface{}{"uuid": uuid, "key": "k", "type": "t", "provider": "p"}
+	var returned string
+	if _, err := InsertOrResolve("ai_model", valuesMap, nil, "name", &returned); err == nil {
+		t.Errorf("Expected the unique violation of an unresolved constraint")
+	}
+}
+
+func TestInsertIdempotent(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+
+	uuid := GenNewUUID("")
+	for i, name := range []string{"first", "retried"} {
+		valuesMap := map[string]interface{}{"uuid": uuid, "key": "k", "name": name, "type": "t", "provider": "p"}
+		var returned string
+		created, err := InsertIdempotent("ai_model", valuesMap, "uuid", "name", &returned)
+		if err != nil {
+			t.Fatalf("InsertIdempotent %d error: %v", i, err)
+		}
+		if created != (i == 0) || returned != "first" {
+			t.Errorf("InsertIdempotent %d: expected created=%v and the first row, got %v and %s", i, i == 0, created, returned)
+		}
+	}
+
+	var count int
+	if err := Db.Get(&count, `SELECT COUNT(*) FROM ai_model WHERE uuid = $1`, uuid); err != nil || count != 1 {
+		t.Errorf("Expected a single row for the idempotency key, got %d, %v", count, err)
+	}
+}
+
+func TestUpsertNullsNotDistinct(t *testing.T) {
+	var version int
+	if err := Db.Get(&version, `SELECT current_setting('server_version_num')::int`); err != nil {
+		t.Fatalf("Failed to read server version: %v", err)
+	}
+	if version < 150000 {
+		t.Skip("NULLS NOT DISTINCT requires PostgreSQL 15")
+	}
+
+	_, err := Db.Exec(`DROP TABLE IF EXISTS upsert_nulls;
+		CREATE TABLE upsert_nulls (uuid UUID PRIMARY KEY, key TEXT, region TEXT, name TEXT NOT NULL);
+		CREATE UNIQUE INDEX upsert_nulls_key_region_uidx ON upsert_nulls (key, region) NULLS NOT DISTINCT`)
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	defer Db.Exec(`DROP TABLE upsert_nulls`)
+	InitModelTagCache(upsertNullsTest{}, "upsert_nulls")
+
+	var row struct {
+		Name string `db:"name"`
+	}
+	for i, name := range []string{"first", "second"} {
+		valuesMap := map[string]interface{}{"uuid": GenNewUUID(""), "key": "k", "region": nil, "name": name}
+		inserted, err := Upsert("upsert_nulls", valuesMap, ConflictColumns("key", "region"), []string{"name"}, &row)
+		if err != nil {
+			t.Fatalf("Upsert error: %v", err)
+		}
+		if inserted != (i == 0) {
+			t.Errorf("Upsert %d: expected inserted=%v with a NULL region", i, i == 0)
+		}
+	}
+
+	var count int
+	if err := Db.Get(&count, `SELECT COUNT(*) FROM upsert_nulls`); err != nil || count != 1 {
+		t.Errorf("Expected a single row, got %d (%v)", count, err)
+	}
+}
+
+func TestLowercaseIdentifiers(t *testing.T) {
+	defer func(lower bool) { LowercaseIdentifiers = lower }(LowercaseIdentifiers)
+
+	if quoteTable("Legacy.MyTable") != `"Legacy"."MyTable"` {
+		t.Errorf("Expected case to be preserved by default")
+	}
+
+	LowercaseIdentifiers = true
+	if quoteTable("Legacy.MyTable") != `"legacy"."mytable"` {
+		t.Errorf("Expected folded table name, got %s", quoteTable("Legacy.MyTable"))
+	}
+	query := SelectBase("website", "").Left("realm", "R", "website.realm_uuid = R.uuid").SelectExpr("1", "One").Build()
+	if !strings.Contains(query, `"r"."uuid" AS "r.uuid"`) || !strings.Contains(query, `1 AS "one"`) {
+		t.Errorf("Expected folded aliases in %q", query)
+	}
+}
+
+func TestStreamJSON(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		aiModel := AIModelTest{
+			Key:      *octypes.NewNullString(fmt.Sprintf("key_%d", i)),
+			Type:     *octypes.NewNullString("test_type"),
+			Provider: *octypes.NewNullString("test_provider"),
+		}
+		if err := aiModel.Insert(); err != nil {
+			t.Fatalf("Insert error: %v", err)
+		}
+	}
+
+	var buf strings.Builder
+	if err := StreamJSON[AIModelTest](&buf, aiModelBaseQuery); err != nil {
+		t.Fatalf("StreamJSON error: %v", err)
+	}
+	var models []AIModelTest
+	if err := json.Unmarshal([]byte(buf.String()), &models); err != nil {
+		t.Fatalf("Invalid JSON %q: %v", buf.String(), err)
+	}
+	if len(models) != 3 {
+		t.Errorf("Expected 3 models, got %d", len(models))
+	}
+
+	buf.Reset()
+	if err := StreamJSON[AIModelTest](&buf, aiModelBaseQuery+` WHERE false`); err != nil || buf.String() != "[]" {
+		t.Errorf("Expected empty array, got %q (%v)", buf.String(), err)
+	}
+}
+
+// setRealmSortExpr registers a sort expression on realm until the test ends
+func setRealmSortExpr(t *testing.T, name string, expr SortExpr) {
+	modelInfo, _ := getModelInfo("realm")
+	previous := modelInfo.sortExprs
+	t.Cleanup(func() { modelInfo.sortExprs = previous })
+	modelInfo.sortExprs = nil
+	SetSortExpr("realm", name, expr)
+}
+
+func TestSortExpr(t *testing.T) {
+	setRealmSortExpr(t, "Touched", SortGreatest("CreatedAt", "UpdatedAt"))
+
+	query, _, err := FilterQuery(realmQuerySelectBase, "realm", nil, &Sort{"Touched": "DESC"}, "realm", 10, 1)
+	if err != nil {
+		t.Fatalf("FilterQuery error: %v", err)
+	}
+	expected := `ORDER BY GREATEST("realm"."created_at", "realm"."updated_at") DESC`
+	if !strings.Contains(query, expected) {
+		t.Errorf("Expected %q in %q", expected, query)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected a panic for an unknown field")
+		}
+	}()
+	SetSortExpr("realm", "Broken", SortCoalesce("Missing"))
+}
+
+func TestBuildFilterCountSortExpr(t *testing.T) {
+	query := realmQuerySelectBase + ` WHERE "realm"."name" IN (SELECT name FROM realm ORDER BY name) ORDER BY GREATEST("realm"."created_at", "realm"."updated_at") DESC LIMIT 10 OFFSET 0`
+	expected := `SELECT COUNT(*) FROM (` + realmQuerySelectBase + ` WHERE "realm"."name" IN (SELECT name FROM realm ORDER BY name)) AS count_subquery`
+	if count := BuildFilterCount(query); count != expected {
+		t.Errorf("Expected %q, got %q", expected, count)
+	}
+}
+
+func TestListSortExpr(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+	setRealmSortExpr(t, "Touched", SortGreatest("CreatedAt", "UpdatedAt"))
+
+	for _, name := range []string{"older", "newer"} {
+		query, args := GetInsertQuery("realm", map[string]interface{}{"uuid": GenNewUUID(""), "name": name}, "")
+		if _, err := Db.Exec(query, args...); err != nil {
+			t.Fatalf("Insert error: %v", err)
+		}
+	}
+
+	result, err := List[RealmTest](realmQuerySelectBase, "realm", nil, &Sort{"Touched": "DESC"}, "realm", 1, 1)
+	if err != nil {
+		t.Fatalf("List error: %v", err)
+	}
+	if len(result.Data) != 1 || result.Data[0].Name != "newer" || result.Pagination.Count != 2 {
+		t.Errorf("Unexpected page %+v", result)
+	}
+}
+
+func TestListBuilder(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+	for _, name := range []string{"first", "second"} {
+		query, args := GetInsertQuery("realm", map[string]interface{}{"uuid": GenNewUUID(""), "name": name}, "")
+		if _, err := Db.Exec(query, args...); err != nil {
+			t.Fatalf("Insert error: %v", err)
+		}
+	}
+
+	result, err := ListBuilder[RealmTest](SelectBase("realm", "r"), &Filter{"Name[$ne]": "first"}, nil, 10, 1)
+	if err != nil {
+		t.Fatalf("ListBuilder error: %v", err)
+	}
+	if len(result.Data) != 1 || result.Data[0].Name != "second" || result.Pagination.Count != 1 {
+		t.Errorf("Unexpected page %+v", result)
+	}
+}
+
+func TestStrictSort(t *testing.T) {
+	defer func(mode SortMode, logger func(QueryEvent)) {
+		StrictSort = mode
+		QueryLogger = logger
+		modelInfo, _ := getModelInfo("ai_model")
+		modelInfo.indexedColumns = nil
+	}(StrictSort, QueryLogger)
+
+	SetIndexedColumns("ai_model", "key", "type")
+
+	StrictSort = SortCheckError
+	if _, err := buildOrderBy("ai_model", &Sort{"Key": "ASC"}, "ai_model"); err != nil {
+		t.Errorf("Unexpected error sorting by indexed column: %v", err)
+	}
+	if _, err := buildOrderBy("ai_model", &Sort{"Name": "ASC"}, "ai_model"); !errors.Is(err, ErrUnindexedSort) {
+		t.Errorf("Expected ErrUnindexedSort, got %v", err)
+	}
+
+	var events []QueryEvent
+	QueryLogger = func(e QueryEvent) { events = append(events, e) }
+	StrictSort = SortCheckWarn
+	orderBy, err := buildOrderBy("ai_model", &Sort{"Name": "ASC"}, "ai_model")
+	if err != nil || len(orderBy) != 1 {
+		t.Errorf("Expected sort to proceed in warn mode, got %v (%v)", orderBy, err)
+	}
+	if len(events) != 1 || !errors.Is(events[0].Err, ErrUnindexedSort) {
+		t.Errorf("Expected an unindexed sort warning, got %v", events)
+	}
+}
+
+type castTest struct {
+	UUID     string `db:"uuid" dbMode:"i"`
+	Settings string `db:"settings" dbMode:"i,u" dbCast:"jsonb"`
+	Kind     string `db:"kind" dbMode:"i,u" dbCast:"model_type" dbInsertValue:"chat"`
+}
+
+func TestDBCast(t *testing.T) {
+	InitModelTagCache(castTest{}, "cast_test")
+
+	query, _ := GetInsertQuery("cast_test", map[string]interface{}{"uuid": "u", "settings": `{"a":1}`}, "")
+	if query != `INSERT INTO "cast_test" ("uuid","settings","kind") VALUES ($1,$2::jsonb,$3::model_type)` {
+		t.Errorf("Unexpected insert query %q", query)
+	}
+
+	query, _, err := GetUpdateQueryE("cast_test", map[string]interface{}{"uuid": "u", "settings": `{}`}, "uuid")
+	if err != nil {
+		t.Fatalf("GetUpdateQueryE error: %v", err)
+	}
+	if !strings.HasPrefix(query, `UPDATE "cast_test" SET "settings" = $1::jsonb WHERE`) {
+		t.Errorf("Unexpected update query %q", query)
+	}
+}
+
+func TestWithTransaction(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+
+	realmUUID := GenNewUUID("")
+	err := WithTransaction(context.Background(), func(tx *sqlx.Tx) error {
+		if err := DeferConstraints(tx); err != nil {
+			return err
+		}
+		query, args := GetInsertQuery("realm", map[string]interface{}{"uuid": realmUUID, "name": "tx realm"}, "")
+		_, err := tx.Exec(query, args...)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("WithTransaction error: %v", err)
+	}
+
+	failure := errors.New("abort")
+	err = WithTransaction(context.Background(), func(tx *sqlx.Tx) error {
+		query, args := GetInsertQuery("realm", map[string]interface{}{"uuid": GenNewUUID(""), "name": "rolled back"}, "")
+		if _, err := tx.Exec(query, args...); err != nil {
+			return err
+		}
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Errorf("Expected the fn error, got %v", err)
+	}
+
+	var count int
+	if err := Db.Get(&count, `SELECT COUNT(*) FROM realm`); err != nil || count != 1 {
+		t.Errorf("Expected only the committed realm, got %d (%v)", count, err)
+	}
+}
+
+func TestWithSerializableTransaction(t *testing.T) {
+	attempts := 0
+	err := WithSerializableTransaction(context.Background(), 3, func(tx *sqlx.Tx) error {
+		attempts++
+		if attempts < 3 {
+			return &pq.Error{Code: "40001"}
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("Expected success on the third attempt, got %v after %d attempts", err, attempts)
+	}
+
+	attempts = 0
+	err = WithSerializableTransaction(context.Background(), 1, func(tx *sqlx.Tx) error {
+		attempts++
+		return &pq.Error{Code: "40P01"}
+	})
+	if err == nil || attempts != 2 {
+		t.Errorf("Expected the deadlock error after 2 attempts, got %v after %d attempts", err, attempts)
+	}
+}
+
+func TestEstimateCount(t *testing.T) {
+	if _, err := EstimateCount("unknown_table"); err == nil {
+		t.Errorf("Expected an error for an unregistered table")
+	}
+	if _, err := Db.Exec(`ANALYZE ai_model`); err != nil {
+		t.Fatalf("ANALYZE error: %v", err)
+	}
+	estimate, err := EstimateCount("ai_model")
+	if err != nil || estimate < 0 {
+		t.Errorf("Expected an estimate after ANALYZE, got %d (%v)", estimate, err)
+	}
+}
+
+func TestCountBy(t *testing.T) {
+	if err := cleanDatabase(); err != nil {
+		t.Fatalf("Failed to clean database: %v", err)
+	}
+	for i, provider := range []string{"openai", "openai", "mistral"} {
+		aiModel := AIModelTest{
+			Key:      *octypes.NewNullString(fmt.Sprintf("key_%d", i)),
+			Type:     *octypes.NewNullString("test_type"),
+			Provider: *octypes.NewNullString(provider),
+		}
+		if i == 0 {
+			aiModel.Name = *octypes.NewNullString("named")
+		}
+		if err := aiModel.Insert(); err != nil {
+			t.Fatalf("Insert error: %v", err)
+		}
+	}
+
+	counts, err := CountBy("ai_model", "Provider", nil)
+	if err != nil {
+		t.Fatalf("CountBy error: %v", err)
+	}
+	if len(counts) != 2 || counts["openai"] != 2 || counts["mistral"] != 1 {
+		t.Errorf("Unexpected counts %v", counts)
+	}
+
+	counts, err = CountBy("ai_model", "Name", &Filter{"Provider": "openai"})
+	if err != nil {
+		t.Fatalf("CountBy error: %v", err)
+	}
+	if counts["named"] != 1 || counts[""] != 1 {
+		t.Errorf("Expected NULL names under the empty key, got %v", counts)
+	}
+}
+
+func TestInitModelTagCacheReturn(t *testing.T) {
+	info := InitModelTagCacheReturn(WebsiteTest{}, "website")
+
+	if strings.Join(info.InsertFields, ",") != "uuid,created_at,updated_at,domain,realm_uuid" {
+		t.Errorf("Unexpected insert fields %v", info.InsertFields)
+	}
+	if strings.Join(info.UpdateFields, ",") != "domain" {
+		t.Errorf("Unexpected update fields %v", info.UpdateFields)
+	}
+	if info.LinkedFields["Realm"] != "r" || info.Fields["RealmUUID"] != "realm_uuid" {
+		t.Errorf("Unexpected fields %v / %v", info.Fields, info.LinkedFields)
+	}
+	if info.InsertValues["created_at"] != "NOW()" {
+		t.Errorf("Unexpected insert values %v", info.InsertValues)
+	}
+
+	info.InsertFields[0] = "changed"
+	if _, fields := GetInsertFields("website"); fields[0] != "uuid" {
+		t.Errorf("ModelInfo is not a copy")
+	}
+}
+
+func TestFiltersFromStruct(t *testing.T) {
+	noType := ""
+	search := struct {
+		Provider string   `filter:"Provider"`
+		Keys     []string `filter:"Key,$in"`
+		Name     string   `filter:"Name,€like"`
+		NotType  *string  `filter:"Type,$ne"`
+		Page     int
+		internal string `filter:"Internal"`
+	}{Provider: "openai", NotType: &noType, Page: 2, internal: "skipped"}
+
+	filters, err := FiltersFromStruct(&search, "ai_model")
+	if err != nil {
+		t.Fatalf("FiltersFromStruct error: %v", err)
+	}
+	if len(*filters) != 2 || (*filters)["Provider"] != "openai" || (*filters)["Type[$ne]"] != "" {
+		t.Errorf("Unexpected filters %v", *filters)
+	}
+
+	cast := struct {
+		Key string `filter:"Key::text,$like"`
+	}{Key: "gpt%"}
+	if filters, err := FiltersFromStruct(cast, "ai_model"); err != nil || (*filters)["Key::text[$like]"] != "gpt%" {
+		t.Errorf("Expected a cast field to resolve to its column, got %v, %v", filters, err)
+	}
+
+	badOperator := struct {
+		Name string `filter:"Name,$approx"`
+	}{}
+	if _, err := FiltersFromStruct(badOperator, "ai_model"); err == nil {
+		t.Errorf("Expected error for unknown operator")
+	}
+	badField := struct {
+		Count int `filter:"Count,$gte"`
+	}{}
+	if _, err := FiltersFromStruct(badField, "ai_model"); err == nil || !strings.Contains(err.Error(), "Count") {
+		t.Errorf("Expected error for a field that isn't a column, got %v", err)
+	}
+	if _, err := FiltersFromStruct(search, "unknown_table"); err == nil {
+		t.Errorf("Expected error for an uninitialized table")
+	}
+}
+
+func TestFilterQueryNoPagination(t *testing.T) {
+	query, args, err := FilterQuery(aiModelBaseQuery, "ai_model", &Filter{"Type": "test_type"}, &Sort{"Key": "ASC"}, "ai_model", 0, 1)
+	if err != nil {
+		t.Fatalf("FilterQuery error: %v", err)
+	}
+	if strings.Contains(query, "LIMIT") || !strings.HasSuffix(query, `ORDER BY "ai_model"."key" ASC`) {
+		t.Errorf("Expected no LIMIT/OFFSET in %q", query)
+	}
+	if count := BuildFilterCount(query); !strings.HasPrefix(count, "SELECT COUNT(*)") || len(args) != 1 {
+		t.Errorf("Unexpected count query %q", count)
+	}
+}
+
+func TestQueryMetricsRows(t *testing.T) {
+	defer func(metrics, logger func(QueryEvent), threshold int64) {
+		QueryMetrics = metrics
+		QueryLogger = logger
+		LargeResultThreshold = threshold
+	}(QueryMetrics, QueryLogger, LargeResultThreshold)
+
+	var metrics, logged []QueryEvent
+	QueryMetrics = func(e QueryEvent) { metrics = append(metrics, e) }
+	QueryLogger = func(e QueryEvent) { logged = append(logged, e) }
+	LargeResultThreshold = 3
+
+	models := make([]AIModelTest, 5)
+	logQuery(context.Background(), "SELECT many", nil, time.Now(), resultRows(&models, nil), nil)
+	few := models[:2]
+	logQuery(context.Background(), "SELECT few", nil, time.Now(), resultRows(&few, nil), nil)
+
+	if len(metrics) != 2 || metrics[0].Rows != 5 {
+		t.Errorf("Expected every query in metrics with its row count, got %+v", metrics)
+	}
+	if len(logged) != 1 || logged[0].Query != "SELECT many" {
+		t.Errorf("Expected only the large result to be logged, got %+v", logged)
+	}
+
+	var model AIModelTest
+	if resultRows(&model, nil) != 1 || resultRows(&model, sql.ErrNoRows) != 0 {
+		t.Errorf("Unexpected row count for a single-row scan")
+	}
+}
+
+func TestQueryTable(t *testing.T) {
+	defer func(metrics func(QueryEvent)) { QueryMetrics = metrics }(QueryMetrics)
+
+	var metrics []QueryEvent
+	QueryMetrics = func(e QueryEvent) { metrics = append(metrics, e) }
+
+	logQuery(WithQueryTable(context.Background(), "ai_model"), "SELECT 1", nil, time.Now(), 1, nil)
+	logQuery(context.Background(), "SELECT 2", nil, time.Now(), 1, nil)
+
+	if len(metrics) != 2 || metrics[0].Table != "ai_model" || metrics[1].Table != "" {
+		t.Errorf("Expected the table of the context in the events, got %+v", metrics)
+	}
+}
+
+func TestNPlusOneDetection(t *testing.T) {
+	defer func(logger func(QueryEvent), threshold int64) {
+		QueryLogger = logger
+		NPlusOneThreshold = threshold
+	}(QueryLogger, NPlusOneThreshold)
+
+	var logged []QueryEvent
+	QueryLogger = func(e QueryEvent) { logged = append(logged, e) }
+	NPlusOneThreshold = 3
+
+	ctx := WithQueryTracking(context.Background())
+	for i := 0; i < 5; i++ {
+		logQuery(ctx, fmt.Sprintf("SELECT * FROM ai_model WHERE uuid = '%d'", i), nil, time.Now(), 1, nil)
+		logQuery(context.Background(), fmt.Sprintf("SELECT * FROM realm WHERE uuid = '%d'", i), nil, time.Now(), 1, nil)
+	}
+
+	if len(logged) != 1 || !strings.Contains(logged[0].Query, "ai_model") || logged[0].Err == nil {
+		t.Errorf("Expected a single N+1 warning for the tracked context, got %+v", logged)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := AIModelTest{
+		UUID: *octypes.NewNullString("uuid"),
+		Key:  *octypes.NewNullString("key"),
+		Name: *octypes.NewNullString("name"),
+	}
+	updated := old
+	updated.Key = *octypes.NewNullString("new_key")
+	updated.Name = octypes.NullString{}
+	updated.Description.String = "ignored while invalid"
+	updated.UUID = *octypes.NewNullString("not updatable")
+
+	changes := Diff(&old, &updated)
+	if len(changes) != 2 || changes["key"] != updated.Key || changes["name"] != updated.Name {
+		t.Errorf("Expected key and name changes only, got %v", changes)
+	}
+
+	type pointers struct {
+		Count  *int    `db:"count"`
+		Label  *string `db:"label"`
+		Total  int     `db:"total" dbMode:"s"`
+		Parent string  `db:"parent" dbMode:"l"`
+	}
+	one, alsoOne, label := 1, 1, "label"
+	changes = Diff(&pointers{Count: &one}, &pointers{Count: &alsoOne, Label: &label, Total: 2, Parent: "p"})
+	if len(changes) != 1 || changes["label"] != &label {
+		t.Errorf("Expected only the label change, got %v", changes)
+	}
+}
+
+func TestQuotedColumns(t *testing.T) {
+	type KeywordTest struct {
+		UUID        string `db:"uuid" dbMode:"i"`
+		Order       string `db:"order" dbMode:"i,u"`
+		DisplayName string `db:"DisplayName" dbMode:"i,u"`
+	}
+	InitModelTagCache(KeywordTest{}, "keyword_test")
+	values := map[string]interface{}{"uuid": "u1", "order": "first", "DisplayName": "Name"}
+
+	query, _ := GetInsertQuery("keyword_test", values, "DisplayName")
+	if query != `INSERT INTO "keyword_test" ("uuid","order","DisplayName") VALUES ($1,$2,$3) RETURNING "keyword_test"."DisplayName"` {
+		t.Errorf("Unexpected insert query %q", query)
+	}
+
+	query, _ = GetUpdateQuery("keyword_test", values, "uuid")
+	if query != `UPDATE "keyword_test" SET "order" = $1, "DisplayName" = $2 WHERE "keyword_test"."uuid" = $3 RETURNING "keyword_test"."uuid"` {
+		t.Errorf("Unexpected update query %q", query)
+	}
+
+	query, _, err := SelectBase("keyword_test", "").FilterQuery(&Filter{"Order": "first"}, &Sort{"DisplayName": "ASC"}, 0, 1)
+	if err != nil {
+		t.Fatalf("FilterQuery error: %v", err)
+	}
+	if !strings.HasSuffix(query, `WHERE "keyword_test"."order" = $1 ORDER BY "keyword_test"."DisplayName" ASC`) {
+		t.Errorf("Unexpected filter query %q", query)
+	}
+
+	query, _, err = GetUpsertQuery("keyword_test", values, ConflictColumns("order"), "DisplayName")
+	if err != nil {
+		t.Fatalf("GetUpsertQuery error: %v", err)
+	}
+	if !strings.HasSuffix(query, `ON CONFLICT ("order") DO UPDATE SET "DisplayName" = EXCLUDED."DisplayName" RETURNING "keyword_test"."DisplayName"`) {
+		t.Errorf("Unexpected upsert query %q", query)
+	}
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	if got := QuoteIdentifier(`odd"name`); got != `"odd""name"` {
+		t.Errorf("Expected doubled quote, got %s", got)
+	}
+	if got := quoteTable(`app.odd"table`); got != `"app"."odd""table"` {
+		t.Errorf("Unexpected quoted table %s", got)
+	}
+	if got := quoteCursorName(`c"1`); got != `"c""1"` {
+		t.Errorf("Unexpected quoted cursor %s", got)
+	}
+}
+
+func TestFilterQueryWithTies(t *testing.T) {
+	query, _, err := FilterQueryWithTies(aiModelBaseQuery, "ai_model", nil, &Sort{"Key": "DESC"}, "ai_model", 3, 2)
+	if err != nil {
+		t.Fatalf("FilterQueryWithTies error: %v", err)
+	}
+	if !strings.HasSuffix(query, `ORDER BY "ai_model"."key" DESC OFFSET 3 ROWS FETCH FIRST 3 ROWS WITH TIES`) {
+		t.Errorf("Unexpected query %q", query)
+	}
+	if count := BuildFilterCount(query); strings.Contains(count, "FETCH") || strings.Contains(count, "ROWS") {
+		t.Errorf("Unexpected count query %q", count)
+	}
+
+	if _, _, err := FilterQueryWithTies(aiModelBaseQuery, "ai_model", nil, nil, "ai_model", 3, 1); err == nil {
+		t.Errorf("Expected error without a sort")
+	}
+}
+
+func TestHealthCheckStop(t *testing.T) {
+	startHealthCheck(Db, time.Hour, 1)
+	if healthCheckStop == nil {
+		t.Fatalf("Expected a running health check")
+	}
+	stopHealthCheck()
+	if healthCheckStop != nil {
+		t.Errorf("Expected the health check to be stopped")
+	}
+	stopHealthCheck()
 }
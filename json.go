@@ -0,0 +1,81 @@
+// json.go
+package fsql
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// GetUpdateJSONFieldQuery builds an UPDATE setting a single path inside a JSONB column with jsonb_set,
+// leaving the rest of the document untouched. It is not tenant scoped; UpdateJSONFieldContext is.
+func GetUpdateJSONFieldQuery(tableName, column string, path []string, value interface{}, whereCol string, whereVal interface{}) (string, []interface{}, error) {
+	modelInfo, ok := getModelInfo(tableName)
+	if !ok {
+		return "", nil, fmt.Errorf("table name not initialized: %s", tableName)
+	}
+	if _, ok := modelInfo.dbFieldsUpdateMap[column]; !ok {
+		return "", nil, fmt.Errorf("column %s is not updatable on table %s", column, tableName)
+	}
+	if _, ok := modelInfo.dbFieldsSelectMap[whereCol]; !ok {
+		return "", nil, fmt.Errorf("unknown column %s on table %s", whereCol, tableName)
+	}
+	if len(path) == 0 {
+		return "", nil, fmt.Errorf("empty json path")
+	}
+
+	jsonValue, err := json.Marshal(value)
+	if err != nil {
+		return "", nil, err
+	}
+
+	quotedTableName := quoteTable(tableName)
+	query := fmt.Sprintf(`UPDATE %s SET %s = jsonb_set(COALESCE(%s, '{}'::jsonb), %s, $1::jsonb) WHERE %s.%s = $2`,
+		quotedTableName, QuoteIdentifier(column), QuoteIdentifier(column), textArrayLiteral(path), quotedTableName, QuoteIdentifier(whereCol))
+	return query, []interface{}{string(jsonValue), whereVal}, nil
+}
+
+// UpdateJSONField executes GetUpdateJSONFieldQuery
+func UpdateJSONField(tableName, column string, path []string, value interface{}, whereCol string, whereVal interface{}) error {
+	return UpdateJSONFieldContext(context.Background(), tableName, column, path, value, whereCol, whereVal)
+}
+
+// UpdateJSONFieldContext is UpdateJSONField restricted to the tenant of ctx. Like the list
+// helpers, it fails with ErrNoTenant on a tenant-scoped table when ctx has no tenant.
+func UpdateJSONFieldContext(ctx context.Context, tableName, column string, path []string, value interface{}, whereCol string, whereVal interface{}) error {
+	query, args, err := getUpdateJSONFieldQuery(ctx, tableName, column, path, value, whereCol, whereVal)
+	if err != nil {
+		return err
+	}
+	_, err = ExecContext(WithQueryTable(ctx, tableName), query, args...)
+	return err
+}
+
+// getUpdateJSONFieldQuery is GetUpdateJSONFieldQuery restricted to the tenant of ctx
+func getUpdateJSONFieldQuery(ctx context.Context, tableName, column string, path []string, value interface{}, whereCol string, whereVal interface{}) (string, []interface{}, error) {
+	query, args, err := GetUpdateJSONFieldQuery(tableName, column, path, value, whereCol, whereVal)
+	if err != nil {
+		return "", nil, err
+	}
+	conditions, tenantArgs, err := tenantConditions(ctx, tableName, len(args)+1)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, condition := range conditions {
+		query += " AND " + condition
+	}
+	return query, append(args, tenantArgs...), nil
+}
+
+// textArrayLiteral renders a quoted Postgres text[] literal such as '{"a","b"}'
+func textArrayLiteral(elements []string) string {
+	quoted := make([]string, len(elements))
+	for i, element := range elements {
+		element = strings.ReplaceAll(element, `\`, `\\`)
+		element = strings.ReplaceAll(element, `"`, `\"`)
+		quoted[i] = `"` + element + `"`
+	}
+	literal := "{" + strings.Join(quoted, ",") + "}"
+	return "'" + strings.ReplaceAll(literal, `'`, `''`) + "'"
+}
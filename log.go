@@ -0,0 +1,207 @@
+// log.go
+package fsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// QueryEvent describes a query passed to QueryMetrics, or to QueryLogger when it failed,
+// was slow or returned a large result
+type QueryEvent struct {
+	Query    string
+	Args     []interface{}
+	Duration time.Duration
+	Err      error
+
+	// Table is the table the query targets, set by the table-aware helpers or WithQueryTable; "" when unknown
+	Table string
+
+	// Rows is the number of rows returned, or affected by an Exec; -1 when unknown
+	Rows int64
+
+	// Occurrences counts the events of the same kind for this query shape so far, sampled ones included
+	Occurrences int64
+}
+
+// QueryLogger, when set, receives the queries issued through fsql that fail, and those
+// taking at least SlowQueryThreshold when it is positive. sql.ErrNoRows is not a failure.
+var QueryLogger func(QueryEvent)
+
+// QueryMetrics, when set, receives every query issued through fsql, without sampling
+var QueryMetrics func(QueryEvent)
+
+// LargeResultThreshold, when positive, also logs the queries returning at least that many
+// rows, to catch endpoints that return thousands of rows because a filter is missing.
+var LargeResultThreshold int64
+
+// SlowQueryThreshold is the duration from which a successful query is logged. Zero logs errors only.
+var SlowQueryThreshold time.Duration
+
+// LogSampleRate logs only the first of every LogSampleRate events of the same query shape,
+// so a query failing under load doesn't flood the logs. Queries differing only by literal
+// values share a shape. 0 or 1 logs every event.
+var LogSampleRate int64
+
+// NPlusOneThreshold, when positive, logs a query shape executed that many times within a
+// context returned by WithQueryTracking, usually a per-row query that should be batched.
+// Meant for development and tests.
+var NPlusOneThreshold int64
+
+// maxQueryEventShapes bounds the query shapes counted for LogSampleRate. The counts start over
+// once it is reached, so queries built with varying identifiers can't grow them without limit.
+var maxQueryEventShapes = 10000
+
+var (
+	queryEventCounts = map[string]int64{}
+	queryEventMu     sync.Mutex
+)
+
+type queryTrackerKey struct{}
+
+type queryTracker struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// WithQueryTracking counts the queries run with ctx per query shape for NPlusOneThreshold.
+// Wrap the context of a single request or test.
+func WithQueryTracking(ctx context.Context) context.Context {
+	return context.WithValue(ctx, queryTrackerKey{}, &queryTracker{counts: map[string]int64{}})
+}
+
+type queryTableKey struct{}
+
+// WithQueryTable attributes the queries run with ctx to table in QueryEvent.Table.
+// The table-aware helpers set it themselves; use it for hand-written queries.
+func WithQueryTable(ctx context.Context, table string) context.Context {
+	return context.WithValue(ctx, queryTableKey{}, table)
+}
+
+// queryTable returns the table set by WithQueryTable, "" when none
+func queryTable(ctx context.Context) string {
+	table, _ := ctx.Value(queryTableKey{}).(string)
+	return table
+}
+
+var (
+	reStringLiteral = regexp.MustCompile(`'(?:[^']|'')*'`)
+	reNumberLiteral = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+	reWhitespace    = regexp.MustCompile(`\s+`)
+)
+
+// normalizeQuery replaces literal values with ? to group identical query shapes
+func normalizeQuery(query string) string {
+	query = reStringLiteral.ReplaceAllString(query, "?")
+	query = rePlaceholder.ReplaceAllString(query, "$$?")
+	query = reNumberLiteral.ReplaceAllString(query, "?")
+	return strings.TrimSpace(reWhitespace.ReplaceAllString(query, " "))
+}
+
+// logQuery reports a finished query to QueryMetrics, and to QueryLogger when it failed,
+// was slow or returned a large result, subject to sampling
+func logQuery(ctx context.Context, query string, args []interface{}, start time.Time, rows int64, err error) {
+	duration := time.Since(start)
+	table := queryTable(ctx)
+	if metrics := QueryMetrics; metrics != nil {
+		metrics(QueryEvent{Query: query, Args: args, Duration: duration, Err: err, Table: table, Rows: rows})
+	}
+
+	if QueryLogger == nil {
+		return
+	}
+	checkNPlusOne(ctx, query, args, table)
+
+	kind := "error"
+	if err == nil || errors.Is(err, sql.ErrNoRows) {
+		switch {
+		case SlowQueryThreshold > 0 && duration >= SlowQueryThreshold:
+			kind = "slow"
+		case LargeResultThreshold > 0 && rows >= LargeResultThreshold:
+			kind = "large"
+		default:
+			return
+		}
+		err = nil
+	}
+	logSampled(kind, QueryEvent{Query: query, Args: args, Duration: duration, Err: err, Table: table, Rows: rows})
+}
+
+// checkNPlusOne logs the query once its shape reaches NPlusOneThreshold executions in the tracked context
+func checkNPlusOne(ctx context.Context, query string, args []interface{}, table string) {
+	if NPlusOneThreshold <= 0 {
+		return
+	}
+	tracker, ok := ctx.Value(queryTrackerKey{}).(*queryTracker)
+	if !ok {
+		return
+	}
+
+	key := normalizeQuery(query)
+	tracker.mu.Lock()
+	tracker.counts[key]++
+	count := tracker.counts[key]
+	tracker.mu.Unlock()
+	if count == NPlusOneThreshold {
+		err := fmt.Errorf("query executed %d times in one context, possible N+1", count)
+		logSampled("n+1", QueryEvent{Query: query, Args: args, Err: err, Table: table, Rows: -1})
+	}
+}
+
+// logSampled passes event to QueryLogger unless sampled out among the events of the same
+// kind and query shape
+func logSampled(kind string, event QueryEvent) {
+	logger := QueryLogger
+	if logger == nil {
+		return
+	}
+
+	key := kind + ":" + normalizeQuery(event.Query)
+	queryEventMu.Lock()
+	if _, ok := queryEventCounts[key]; !ok && len(queryEventCounts) >= maxQueryEventShapes {
+		queryEventCounts = map[string]int64{}
+	}
+	queryEventCounts[key]++
+	occurrences := queryEventCounts[key]
+	queryEventMu.Unlock()
+	if LogSampleRate > 1 && (occurrences-1)%LogSampleRate != 0 {
+		return
+	}
+
+	event.Occurrences = occurrences
+	logger(event)
+}
+
+// resultRows counts the rows scanned into dest, a pointer to a slice for selects
+func resultRows(dest interface{}, err error) int64 {
+	if err != nil {
+		return 0
+	}
+	v := reflect.ValueOf(dest)
+	for v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Slice {
+		return int64(v.Len())
+	}
+	return 1
+}
+
+// affectedRows reads RowsAffected, -1 when unavailable
+func affectedRows(result sql.Result, err error) int64 {
+	if err != nil || result == nil {
+		return -1
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return -1
+	}
+	return n
+}
@@ -1,10 +1,18 @@
 package fsql
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"fmt"
+	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 type Join struct {
@@ -12,24 +20,116 @@ type Join struct {
 	TableAlias  string
 	JoinType    string
 	OnCondition string
+
+	// Columns are selected instead of the model fields when joining a non-model source such as a CTE
+	Columns []string
+
+	// Raw is a caller-provided join clause rendered verbatim, selecting no columns by itself.
+	// Its placeholders are numbered from $1 like a CTE's and bound to Args.
+	Raw  string
+	Args []interface{}
+}
+
+// CTE is a named common table expression rendered in the WITH clause.
+// Its placeholders are numbered from $1 and shifted by BuildWithArgs.
+type CTE struct {
+	Name    string
+	Columns []string
+	Query   string
+	Args    []interface{}
 }
 
+// QueryBuilder builds SELECT queries. Builders are immutable: every fluent method returns
+// a modified copy and leaves the receiver untouched, so a configured builder can be shared
+// across goroutines and used as a base for per-request variants.
+//
+// This changed from earlier versions, where the fluent methods modified the receiver. A call
+// whose result is discarded, such as qb.Left(...) on its own line, no longer has any effect;
+// assign the result instead: qb = qb.Left(...).
 type QueryBuilder struct {
-	Table string
-	Joins []Join
+	Table  string
+	Alias  string
+	Joins  []Join
+	Exprs  []string
+	Groups []string
+	CTEs   []CTE
+
+	// Source replaces the table in the FROM clause, aliased as the table, e.g. a CTE added with With
+	Source string
+
+	// Coalesces maps base table columns to the SQL literal selected when they are NULL
+	Coalesces map[string]string
+
+	// FlatAliases selects join columns as "alias_column" instead of "alias.column"
+	FlatAliases bool
+
+	// SamplePercent, when positive, reads the table through TABLESAMPLE SYSTEM
+	SamplePercent float64
+
+	// Locking is the row lock strength ending every query the builder outputs except counts,
+	// e.g. "FOR NO KEY UPDATE", and LockWait its optional "SKIP LOCKED" or "NOWAIT". Filter a
+	// locking builder with its FilterQuery, since conditions appended to Build() would follow it.
+	Locking  string
+	LockWait string
 }
 
+// GetInsertQuery builds the INSERT for the model's insert fields.
+// Columns tagged dbMode:"uuid" that are missing from valuesMap get a generated UUID, bound
+// among the returned args; valuesMap itself is never modified, so return the column to read
+// the generated value back. Other columns missing from valuesMap without a dbInsertValue
+// are inserted as DEFAULT. Columns are listed in struct
+// field declaration order, independent of valuesMap.
 func GetInsertQuery(tableName string, valuesMap map[string]interface{}, returning string) (string, []interface{}) {
+	return getInsertQuery(tableName, valuesMap, returning, insertOptions{})
+}
+
+// GetInsertQueryOmitMissing is GetInsertQuery leaving the columns that would be inserted
+// as DEFAULT out of the column list, so a NOT NULL violation names the missing column.
+func GetInsertQueryOmitMissing(tableName string, valuesMap map[string]interface{}, returning string) (string, []interface{}) {
+	return getInsertQuery(tableName, valuesMap, returning, insertOptions{omitMissing: true})
+}
+
+// GetInsertQuerySkipNull is GetInsertQuery treating the values whose driver.Valuer returns
+// (nil, nil), such as an invalid octypes.NullString, as missing from valuesMap, so the
+// column's dbInsertValue or database default applies instead of an explicit NULL.
+func GetInsertQuerySkipNull(tableName string, valuesMap map[string]interface{}, returning string) (string, []interface{}) {
+	return getInsertQuery(tableName, valuesMap, returning, insertOptions{skipNull: true})
+}
+
+type insertOptions struct {
+	omitMissing bool // leave missing columns out instead of inserting DEFAULT
+	skipNull    bool // treat NULL Valuers as missing
+}
+
+func getInsertQuery(tableName string, valuesMap map[string]interface{}, returning string, opts insertOptions) (string, []interface{}) {
 	_, fields := GetInsertFields(tableName)
 	defaultValues := GetInsertValues(tableName)
+	modelInfo, _ := getModelInfo(tableName)
+	if len(returning) > 0 {
+		if err := validateReturning(tableName, returning); err != nil {
+			panic(err.Error())
+		}
+	}
 
+	// Generated values go into a copy so a shared or reused valuesMap is left as is
+	values := make(map[string]interface{}, len(valuesMap)+len(modelInfo.uuidFields))
+	for field, value := range valuesMap {
+		values[field] = value
+	}
+	for field := range modelInfo.uuidFields {
+		if _, ok := values[field]; !ok {
+			values[field] = GenNewUUID(tableName)
+		}
+	}
+
+	columns := []string{}
 	placeholders := []string{}
 	queryValues := []interface{}{}
 	counter := 1
 	for _, field := range fields {
-		if val, ok := valuesMap[field]; ok {
+		if val, ok := values[field]; ok && !(opts.skipNull && isNullValuer(val)) {
 			// If value is provided in valuesMap, use it
-			placeholders = append(placeholders, fmt.Sprintf("$%d", counter))
+			placeholders = append(placeholders, castPlaceholder(modelInfo, field, counter))
 			queryValues = append(queryValues, val)
 			counter++
 		} else if defVal, ok := defaultValues[field]; ok {
@@ -37,29 +137,179 @@ func GetInsertQuery(tableName string, valuesMap map[string]interface{}, returnin
 			if defVal == "NOW()" || defVal == "NULL" || defVal == "true" || defVal == "false" || defVal == "DEFAULT" {
 				placeholders = append(placeholders, defVal)
 			} else {
-				placeholders = append(placeholders, fmt.Sprintf("$%d", counter))
+				placeholders = append(placeholders, castPlaceholder(modelInfo, field, counter))
 				queryValues = append(queryValues, defVal)
 				counter++
 			}
+		} else if opts.omitMissing {
+			continue
+		} else {
+			placeholders = append(placeholders, "DEFAULT")
 		}
+		columns = append(columns, QuoteIdentifier(field))
 	}
 
-	query := fmt.Sprintf(`INSERT INTO "%s" (%s) VALUES (%s)`, tableName, strings.Join(fields, ","), strings.Join(placeholders, ","))
+	query := fmt.Sprintf(`INSERT INTO %s (%s) VALUES (%s)`, quoteTable(tableName), strings.Join(columns, ","), strings.Join(placeholders, ","))
 	if len(returning) > 0 {
-		query += fmt.Sprintf(` RETURNING "%s".%s`, tableName, returning)
+		query += fmt.Sprintf(` RETURNING %s.%s`, quoteTable(tableName), QuoteIdentifier(returning))
 	}
 	return query, queryValues
 }
 
+// isNullValuer reports whether value is a driver.Valuer, or a nil pointer to one, valued NULL
+func isNullValuer(value interface{}) bool {
+	valuer, ok := value.(driver.Valuer)
+	if !ok {
+		return false
+	}
+	if v := reflect.ValueOf(value); v.Kind() == reflect.Ptr && v.IsNil() {
+		return true
+	}
+	driverValue, err := valuer.Value()
+	return err == nil && driverValue == nil
+}
+
+// ReturningExpr is a computed RETURNING expression scanned under Alias.
+// Expr is trusted SQL and is not validated against the model.
+type ReturningExpr struct {
+	Expr  string
+	Alias string
+}
+
+// GetInsertQueryReturning is GetInsertQuery returning several model columns
+// plus computed expressions, e.g. ReturningExpr{"price * 1.2", "price_with_tax"}.
+func GetInsertQueryReturning(tableName string, valuesMap map[string]interface{}, returning []string, exprs ...ReturningExpr) (string, []interface{}, error) {
+	clause, err := returningClause(tableName, returning, exprs...)
+	if err != nil {
+		return "", nil, err
+	}
+	query, queryValues := GetInsertQuery(tableName, valuesMap, "")
+	return query + clause, queryValues, nil
+}
+
+// InsertReturning executes GetInsertQueryReturning and scans the returned columns
+// and expression aliases into dest, a pointer to a struct with matching db tags.
+func InsertReturning(dest interface{}, tableName string, valuesMap map[string]interface{}, returning []string, exprs ...ReturningExpr) error {
+	query, args, err := GetInsertQueryReturning(tableName, valuesMap, returning, exprs...)
+	if err != nil {
+		return err
+	}
+	return GetContext(WithQueryTable(context.Background(), tableName), dest, query, args...)
+}
+
+// InsertReturningMap inserts valuesMap and returns the whole inserted row (RETURNING *)
+// keyed by column, for generic code without a model type. JSON columns are decoded and
+// arrays are scanned into Go slices.
+func InsertReturningMap(tableName string, valuesMap map[string]interface{}) (map[string]interface{}, error) {
+	query, args := GetInsertQuery(tableName, valuesMap, "")
+	query += " RETURNING *"
+
+	ctx, cancel := withDefaultTimeout(WithQueryTable(context.Background(), tableName))
+	defer cancel()
+	start := time.Now()
+	rows, err := Db.QueryxContext(ctx, query, args...)
+	logQuery(ctx, query, args, start, 1, err)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+	row := map[string]interface{}{}
+	if err := rows.MapScan(row); err != nil {
+		return nil, err
+	}
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	for _, columnType := range columnTypes {
+		value, err := decodeMapValue(columnType.DatabaseTypeName(), row[columnType.Name()])
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", columnType.Name(), err)
+		}
+		row[columnType.Name()] = value
+	}
+	return row, rows.Close()
+}
+
+// decodeMapValue converts the raw bytes MapScan leaves for JSON and array columns
+func decodeMapValue(typeName string, value interface{}) (interface{}, error) {
+	raw, ok := value.([]byte)
+	if !ok {
+		return value, nil
+	}
+
+	var scanner sql.Scanner
+	switch typeName {
+	case "JSON", "JSONB":
+		var decoded interface{}
+		if err := json.Unmarshal(raw, &decoded); err != nil {
+			return nil, err
+		}
+		return decoded, nil
+	case "_TEXT", "_VARCHAR", "_BPCHAR", "_UUID":
+		scanner = &pq.StringArray{}
+	case "_INT2", "_INT4", "_INT8":
+		scanner = &pq.Int64Array{}
+	case "_FLOAT4", "_FLOAT8", "_NUMERIC":
+		scanner = &pq.Float64Array{}
+	case "_BOOL":
+		scanner = &pq.BoolArray{}
+	case "TEXT", "VARCHAR", "BPCHAR", "UUID", "NUMERIC":
+		return string(raw), nil
+	default:
+		return value, nil
+	}
+	if err := scanner.Scan(raw); err != nil {
+		return nil, err
+	}
+	return reflect.ValueOf(scanner).Elem().Interface(), nil
+}
+
+// castPlaceholder renders $n, with the column's dbCast tag as $n::type
+func castPlaceholder(modelInfo *modelInfo, column string, n int) string {
+	if cast, ok := modelInfo.dbCasts[column]; ok {
+		return fmt.Sprintf("$%d::%s", n, cast)
+	}
+	return fmt.Sprintf("$%d", n)
+}
+
+// GetUpdateQuery builds the UPDATE of the update fields present in valuesMap, keyed by the
+// returning column. Columns tagged dbUpdateValue that are missing from valuesMap are set to
+// that SQL expression, rendered verbatim, e.g. dbUpdateValue:"NOW()" or "revision + 1".
 func GetUpdateQuery(tableName string, valuesMap map[string]interface{}, returning string) (string, []interface{}) {
-	_, fields := GetUpdateFields(tableName)
+	query, queryValues, err := GetUpdateQueryE(tableName, valuesMap, returning)
+	if err != nil {
+		panic(err.Error())
+	}
+	return query, queryValues
+}
+
+// GetUpdateQueryE is GetUpdateQuery returning an error instead of panicking
+// when the table is unknown, nothing is updated or the key is missing from valuesMap.
+func GetUpdateQueryE(tableName string, valuesMap map[string]interface{}, returning string) (string, []interface{}, error) {
+	_, fields, err := getFieldsByModeE(tableName, "update", "", ".")
+	if err != nil {
+		return "", nil, err
+	}
+	if err := validateReturning(tableName, returning); err != nil {
+		return "", nil, err
+	}
+	modelInfo, _ := getModelInfo(tableName)
 	setClauses := []string{}
 	queryValues := []interface{}{}
 	counter := 1
 
 	for _, field := range fields {
 		if value, exists := valuesMap[field]; exists {
-			setClause := fmt.Sprintf(`%s = $%d`, field, counter)
+			setClause := fmt.Sprintf(`%s = %s`, QuoteIdentifier(field), castPlaceholder(modelInfo, field, counter))
 
 			setClauses = append(setClauses, setClause)
 			queryValues = append(queryValues, value)
@@ -67,24 +317,67 @@ func GetUpdateQuery(tableName string, valuesMap map[string]interface{}, returnin
 		}
 	}
 
-	query := fmt.Sprintf(`UPDATE "%s" SET %s WHERE "%s"."%s" = $%d RETURNING "%s".%s`, tableName, strings.Join(setClauses, ", "), tableName, returning, counter, tableName, returning)
+	if len(setClauses) == 0 {
+		return "", nil, fmt.Errorf("no fields to update for table %s", tableName)
+	}
+	for _, field := range modelInfo.dbFieldsSelect {
+		if expr, ok := modelInfo.dbUpdateValueMap[field]; ok {
+			if _, provided := valuesMap[field]; !provided {
+				setClauses = append(setClauses, fmt.Sprintf(`%s = %s`, QuoteIdentifier(field), expr))
+			}
+		}
+	}
+
 	uuidValue, uuidExists := valuesMap[returning]
 	if !uuidExists {
-		panic(fmt.Sprintf("UUID not found in valuesMap: %v", valuesMap))
+		return "", nil, fmt.Errorf("UUID not found in valuesMap: %v", valuesMap)
 	}
+
+	quotedTableName := quoteTable(tableName)
+	query := fmt.Sprintf(`UPDATE %s SET %s WHERE %s.%s = $%d RETURNING %s.%s`, quotedTableName, strings.Join(setClauses, ", "), quotedTableName, QuoteIdentifier(returning), counter, quotedTableName, QuoteIdentifier(returning))
 	queryValues = append(queryValues, uuidValue)
 
-	return query, queryValues
+	return query, queryValues, nil
 }
 
+// SelectBase starts a builder selecting the model columns of table. A non-empty alias other
+// than the table name renders FROM "table" AS "alias" and qualifies the base columns with it.
 func SelectBase(table string, alias string) *QueryBuilder {
+	if alias == table {
+		alias = ""
+	}
 	return &QueryBuilder{
 		Table: table,
+		Alias: alias,
 		Joins: []Join{},
 	}
 }
 
+// Qualifier is the name qualifying the base table columns, its alias or the table name.
+// Pass it as the t parameter of the filter functions when building around the builder.
+func (qb *QueryBuilder) Qualifier() string {
+	if qb.Alias != "" {
+		return qb.Alias
+	}
+	return qb.Table
+}
+
+// Clone returns an independent copy of the builder
+func (qb *QueryBuilder) Clone() *QueryBuilder {
+	clone := *qb
+	clone.Joins = append([]Join{}, qb.Joins...)
+	clone.Exprs = append([]string{}, qb.Exprs...)
+	clone.Groups = append([]string{}, qb.Groups...)
+	clone.CTEs = append([]CTE{}, qb.CTEs...)
+	clone.Coalesces = make(map[string]string, len(qb.Coalesces))
+	for column, def := range qb.Coalesces {
+		clone.Coalesces[column] = def
+	}
+	return &clone
+}
+
 func (qb *QueryBuilder) Left(table string, alias string, on string) *QueryBuilder {
+	qb = qb.Clone()
 	qb.Joins = append(qb.Joins, Join{
 		Table:       table,
 		TableAlias:  alias,
@@ -94,25 +387,405 @@ func (qb *QueryBuilder) Left(table string, alias string, on string) *QueryBuilde
 	return qb
 }
 
+// WithValues adds a WITH name(columns) AS (VALUES ...) CTE of constant rows, each row holding
+// one value per column. Join it with LeftCTE to enrich results without a temporary table.
+// Values are sent as text, so declare the type of a column joined on a non-text column as
+// "column::type", e.g. "realm_uuid::uuid", to cast its placeholders; the type is trusted SQL.
+func (qb *QueryBuilder) WithValues(name string, columns []string, rows [][]interface{}) *QueryBuilder {
+	names := make([]string, len(columns))
+	casts := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column
+		if j := strings.Index(column, "::"); j >= 0 {
+			names[i], casts[i] = column[:j], "::"+column[j+2:]
+		}
+	}
+
+	values := []string{}
+	args := []interface{}{}
+	for _, row := range rows {
+		if len(row) != len(columns) {
+			panic(fmt.Sprintf("values row for %s has %d values, expected %d", name, len(row), len(columns)))
+		}
+		placeholders := Placeholders(len(args)+1, len(row))
+		for i := range placeholders {
+			placeholders[i] += casts[i]
+		}
+		values = append(values, "("+strings.Join(placeholders, ",")+")")
+		args = append(args, row...)
+	}
+
+	qb = qb.Clone()
+	qb.CTEs = append(qb.CTEs, CTE{
+		Name:    name,
+		Columns: names,
+		Query:   "VALUES " + strings.Join(values, ","),
+		Args:    args,
+	})
+	return qb
+}
+
+// With adds a CTE named name whose query is built from sub, along with its args.
+// CTEs are rendered in the order they are added; select from one with From or LeftCTE.
+func (qb *QueryBuilder) With(name string, sub *QueryBuilder) *QueryBuilder {
+	query, args := sub.BuildWithArgs()
+	qb = qb.Clone()
+	qb.CTEs = append(qb.CTEs, CTE{Name: name, Query: query, Args: args})
+	return qb
+}
+
+// From selects from source, typically a CTE, aliased as the builder's table so its model
+// columns, filters and sorts apply unchanged. Source must expose the table's select columns.
+func (qb *QueryBuilder) From(source string) *QueryBuilder {
+	qb = qb.Clone()
+	qb.Source = source
+	return qb
+}
+
+// Sample reads an approximate percent of the table's pages with TABLESAMPLE SYSTEM,
+// for fast approximate statistics over large tables. percent must be in (0, 100].
+func (qb *QueryBuilder) Sample(percent float64) *QueryBuilder {
+	if !(percent > 0 && percent <= 100) {
+		panic(fmt.Sprintf("invalid sample percent %v", percent))
+	}
+	qb = qb.Clone()
+	qb.SamplePercent = percent
+	return qb
+}
+
+// ForUpdate locks the selected rows of the base table FOR UPDATE
+func (qb *QueryBuilder) ForUpdate() *QueryBuilder {
+	return qb.lock("FOR UPDATE")
+}
+
+// ForNoKeyUpdate locks the selected rows FOR NO KEY UPDATE, which unlike FOR UPDATE doesn't
+// block foreign key checks of other transactions. Use it when the key columns aren't updated,
+// e.g. to claim queue jobs.
+func (qb *QueryBuilder) ForNoKeyUpdate() *QueryBuilder {
+	return qb.lock("FOR NO KEY UPDATE")
+}
+
+// ForShare locks the selected rows FOR SHARE
+func (qb *QueryBuilder) ForShare() *QueryBuilder {
+	return qb.lock("FOR SHARE")
+}
+
+// SkipLocked skips the rows locked by other transactions instead of waiting for them
+func (qb *QueryBuilder) SkipLocked() *QueryBuilder {
+	return qb.lockModifier("SKIP LOCKED")
+}
+
+// NoWait fails instead of waiting for rows locked by other transactions
+func (qb *QueryBuilder) NoWait() *QueryBuilder {
+	return qb.lockModifier("NOWAIT")
+}
+
+func (qb *QueryBuilder) lock(strength string) *QueryBuilder {
+	qb = qb.Clone()
+	qb.Locking = strength
+	return qb
+}
+
+func (qb *QueryBuilder) lockModifier(modifier string) *QueryBuilder {
+	if qb.Locking == "" {
+		panic(modifier + " requires a locking clause")
+	}
+	qb = qb.Clone()
+	qb.LockWait = modifier
+	return qb
+}
+
+// lockingClause renders Locking, restricted to the base table when there are joins
+// since the nullable side of an outer join can't be locked
+func (qb *QueryBuilder) lockingClause() string {
+	if qb.Locking == "" {
+		return ""
+	}
+	clause := " " + qb.Locking
+	if len(qb.Joins) > 0 {
+		clause += " OF " + QuoteIdentifier(qb.lockTarget())
+	}
+	if qb.LockWait != "" {
+		clause += " " + qb.LockWait
+	}
+	return clause
+}
+
+// lockTarget is the base table name accepted by OF: its alias, or the table without its schema
+func (qb *QueryBuilder) lockTarget() string {
+	if qb.Alias != "" {
+		return qb.Alias
+	}
+	return qb.Table[strings.LastIndex(qb.Table, ".")+1:]
+}
+
+// LeftCTE left joins a CTE of the builder, selecting its columns like a joined model's
+func (qb *QueryBuilder) LeftCTE(name string, alias string, on string) *QueryBuilder {
+	for _, cte := range qb.CTEs {
+		if cte.Name == name {
+			qb = qb.Clone()
+			qb.Joins = append(qb.Joins, Join{
+				Table:       name,
+				TableAlias:  alias,
+				JoinType:    "LEFT JOIN",
+				OnCondition: on,
+				Columns:     cte.Columns,
+			})
+			return qb
+		}
+	}
+	panic("unknown CTE: " + name)
+}
+
+// JoinRaw appends a join clause verbatim, e.g. a LATERAL join or a join on a subquery source.
+// Select its columns with SelectExpr; its args are returned by BuildWithArgs.
+func (qb *QueryBuilder) JoinRaw(joinSQL string, args ...interface{}) *QueryBuilder {
+	qb = qb.Clone()
+	qb.Joins = append(qb.Joins, Join{Raw: joinSQL, Args: args})
+	return qb
+}
+
+// Flat makes join columns use underscore-flattened aliases for scanning into flat structs
+func (qb *QueryBuilder) Flat() *QueryBuilder {
+	qb = qb.Clone()
+	qb.FlatAliases = true
+	return qb
+}
+
+// SelectExpr appends a raw expression to the SELECT list under the given alias
+func (qb *QueryBuilder) SelectExpr(expr string, alias string) *QueryBuilder {
+	qb = qb.Clone()
+	qb.Exprs = append(qb.Exprs, fmt.Sprintf(`%s AS %s`, expr, QuoteIdentifier(alias)))
+	return qb
+}
+
+// SelectSubquery appends a parenthesized scalar subquery to the SELECT list under the given alias.
+// The subquery may reference the outer table by its name or alias.
+func (qb *QueryBuilder) SelectSubquery(subquery string, alias string) *QueryBuilder {
+	return qb.SelectExpr("("+subquery+")", alias)
+}
+
+// SelectJSONAgg selects the rows of childTable matching onCondition as a JSON array of
+// objects keyed by column, under alias, with a correlated json_agg subquery. The parent rows
+// are not multiplied; scan the array into a JSONSlice field tagged db:"alias".
+func (qb *QueryBuilder) SelectJSONAgg(childTable, alias, onCondition string) *QueryBuilder {
+	_, fieldNames := GetSelectFields(childTable, "")
+	pairs := make([]string, len(fieldNames))
+	for i, column := range fieldNames {
+		pairs[i] = sqlLiteral(column) + ", " + QuoteIdentifier(alias) + "." + QuoteIdentifier(column)
+	}
+	subquery := fmt.Sprintf(`SELECT COALESCE(json_agg(json_build_object(%s)), '[]') FROM %s AS %s WHERE %s`,
+		strings.Join(pairs, ", "), quoteTable(childTable), QuoteIdentifier(alias), onCondition)
+	return qb.SelectSubquery(subquery, alias)
+}
+
+// CoalesceColumn selects a nullable model field of the base table as COALESCE(column, def),
+// keeping the column name as alias so it still scans into the same field.
+func (qb *QueryBuilder) CoalesceColumn(field string, def interface{}) *QueryBuilder {
+	modelInfo, ok := getModelInfo(qb.Table)
+	if !ok {
+		panic("table name not initialized: " + qb.Table)
+	}
+	dbField, exists := modelInfo.dbTagMap[field]
+	if !exists {
+		panic(fmt.Sprintf("unknown field %s for table %s", field, qb.Table))
+	}
+
+	qb = qb.Clone()
+	qb.Coalesces[dbField] = sqlLiteral(def)
+	return qb
+}
+
+// sqlLiteral renders a default value as an SQL literal
+func sqlLiteral(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return fmt.Sprintf("%v", v)
+	default:
+		panic(fmt.Sprintf("unsupported literal type %T", value))
+	}
+}
+
+// GroupBy groups the query by the given model fields of the base table.
+// A grouped query only selects the grouped columns and the SelectExpr expressions.
+// Filter it with the builder's FilterQuery, which places the WHERE ahead of the GROUP BY.
+func (qb *QueryBuilder) GroupBy(fields ...string) *QueryBuilder {
+	qb = qb.Clone()
+	modelInfo, ok := getModelInfo(qb.Table)
+	if !ok {
+		panic("table name not initialized: " + qb.Table)
+	}
+	for _, field := range fields {
+		dbField, exists := modelInfo.dbTagMap[field]
+		if !exists {
+			panic(fmt.Sprintf("unknown field %s for table %s", field, qb.Table))
+		}
+		qb.Groups = append(qb.Groups, quoteTable(qb.Qualifier())+"."+QuoteIdentifier(dbField))
+	}
+	return qb
+}
+
+// GroupCount selects COUNT(*) AS group_count, to be scanned into a `db:"group_count"` field
+func (qb *QueryBuilder) GroupCount() *QueryBuilder {
+	return qb.SelectExpr("COUNT(*)", "group_count")
+}
+
 func (qb *QueryBuilder) Build() string {
-	fieldsArray, _ := GetSelectFields(qb.Table, "")
-	fields := strings.Join(fieldsArray, ",")
+	query, _ := qb.BuildWithArgs()
+	return query
+}
 
-	for _, join := range qb.Joins {
-		fieldsArray, _ := GetSelectFields(join.Table, join.TableAlias)
-		fields += ", " + strings.Join(fieldsArray, ",")
+// BuildWithArgs builds the query along with the arguments of its CTEs and raw joins, numbered in order
+func (qb *QueryBuilder) BuildWithArgs() (string, []interface{}) {
+	query, args := qb.buildWhere("")
+	return query + qb.lockingClause(), args
+}
+
+// buildWhere builds the query with a WHERE clause ahead of the builder's GROUP BY
+func (qb *QueryBuilder) buildWhere(where string) (string, []interface{}) {
+	var args []interface{}
+	var ctes []string
+	for _, cte := range qb.CTEs {
+		name := quoteTable(cte.Name)
+		if len(cte.Columns) > 0 {
+			columns := make([]string, len(cte.Columns))
+			for i, column := range cte.Columns {
+				columns[i] = QuoteIdentifier(column)
+			}
+			name += "(" + strings.Join(columns, ",") + ")"
+		}
+		ctes = append(ctes, fmt.Sprintf(`%s AS (%s)`, name, shiftPlaceholders(cte.Query, len(args))))
+		args = append(args, cte.Args...)
+	}
+
+	var fields string
+	if len(qb.Groups) > 0 {
+		fields = strings.Join(qb.Groups, ",")
+	} else {
+		fieldsArray, fieldNames := GetSelectFields(qb.Table, "")
+		for i, column := range fieldNames {
+			if qb.Alias != "" {
+				fieldsArray[i] = quoteTable(qb.Qualifier()) + "." + QuoteIdentifier(column)
+			}
+			if def, ok := qb.Coalesces[column]; ok {
+				fieldsArray[i] = fmt.Sprintf(`COALESCE(%s, %s) AS %s`, fieldsArray[i], def, QuoteIdentifier(column))
+			}
+		}
+		fields = strings.Join(fieldsArray, ",")
+
+		for _, join := range qb.Joins {
+			var fieldsArray []string
+			if join.Raw != "" {
+				continue
+			} else if join.Columns != nil {
+				fieldsArray = joinColumns(join, qb.FlatAliases)
+			} else if qb.FlatAliases {
+				fieldsArray, _ = GetSelectFieldsFlat(join.Table, join.TableAlias)
+			} else {
+				fieldsArray, _ = GetSelectFields(join.Table, join.TableAlias)
+			}
+			fields += ", " + strings.Join(fieldsArray, ",")
+		}
+	}
+
+	if len(qb.Exprs) > 0 {
+		fields += ", " + strings.Join(qb.Exprs, ", ")
 	}
 
 	var joins []string
 	for _, join := range qb.Joins {
-		table := join.Table
+		if join.Raw != "" {
+			joins = append(joins, " "+shiftPlaceholders(join.Raw, len(args))+" ")
+			args = append(args, join.Args...)
+			continue
+		}
+		table := quoteTable(join.Table)
 		if join.TableAlias != "" {
-			table = fmt.Sprintf(`"%s" AS %s`, join.Table, join.TableAlias)
+			table = fmt.Sprintf(`%s AS %s`, table, join.TableAlias)
 		}
 		joins = append(joins, fmt.Sprintf(` %s %s ON %s `, join.JoinType, table, join.OnCondition))
 	}
 
-	return fmt.Sprintf(`SELECT %s FROM "%s" %s`, fields, qb.Table, strings.Join(joins, " "))
+	from := quoteTable(qb.Table)
+	if qb.Source != "" {
+		from = quoteTable(qb.Source) + " AS " + quoteTable(qb.Qualifier())
+	} else if qb.Alias != "" {
+		from += " AS " + quoteTable(qb.Qualifier())
+	}
+	if qb.SamplePercent > 0 && qb.Source == "" {
+		from += " TABLESAMPLE SYSTEM (" + strconv.FormatFloat(qb.SamplePercent, 'g', -1, 64) + ")"
+	}
+	query := fmt.Sprintf(`SELECT %s FROM %s %s`, fields, from, strings.Join(joins, " "))
+	if where != "" {
+		query += " WHERE " + where
+	}
+	if len(qb.Groups) > 0 {
+		query += " GROUP BY " + strings.Join(qb.Groups, ", ")
+	}
+	if len(ctes) > 0 {
+		query = "WITH " + strings.Join(ctes, ", ") + " " + query
+	}
+	return query, args
+}
+
+// joinColumns selects the explicit columns of a non-model join with the usual alias convention
+func joinColumns(join Join, flat bool) []string {
+	alias := join.TableAlias
+	if alias == "" {
+		alias = join.Table
+	}
+	sep := "."
+	if flat {
+		sep = "_"
+	}
+
+	fields := make([]string, len(join.Columns))
+	for i, column := range join.Columns {
+		fields[i] = QuoteIdentifier(alias) + "." + QuoteIdentifier(column) + " AS " + QuoteIdentifier(alias+sep+column)
+	}
+	return fields
+}
+
+// FilterQuery applies FilterQuery to the builder's query, numbering the filter placeholders
+// after the builder's own arguments, and appends the builder's locking clause.
+func (qb *QueryBuilder) FilterQuery(filters *Filter, sort *Sort, perPage int, page int) (string, []interface{}, error) {
+	_, args := qb.BuildWithArgs()
+	plan, err := planFilterQuery(qb.Qualifier(), filters, sort, qb.Table, perPage, page, len(args)+1)
+	if err != nil {
+		return "", nil, err
+	}
+	query, _ := qb.buildWhere(strings.Join(plan.Conditions, " AND "))
+	plan.Conditions = nil
+	return plan.SQL(query) + qb.lockingClause(), append(args, plan.Args...), nil
+}
+
+// FilterCountQuery is FilterCountQuery filtering the builder's table under its qualifier
+func (qb *QueryBuilder) FilterCountQuery(filters *Filter) (string, []interface{}, error) {
+	return FilterCountQuery(qb, qb.Qualifier(), filters, qb.Table)
+}
+
+// BuildCount builds a COUNT(*) query for the builder. Without joins or grouping the table is
+// counted directly; otherwise the full select is wrapped in a subquery.
+func (qb *QueryBuilder) BuildCount() string {
+	if qb.isSimpleCount() {
+		if qb.Alias != "" {
+			return fmt.Sprintf(`SELECT COUNT(*) FROM %s AS %s`, quoteTable(qb.Table), quoteTable(qb.Qualifier()))
+		}
+		return fmt.Sprintf(`SELECT COUNT(*) FROM %s`, quoteTable(qb.Table))
+	}
+	query, _ := qb.buildWhere("")
+	return fmt.Sprintf("SELECT COUNT(*) FROM (%s) AS count_subquery", query)
+}
+
+func (qb *QueryBuilder) isSimpleCount() bool {
+	return len(qb.Joins) == 0 && len(qb.Groups) == 0 && len(qb.CTEs) == 0 && qb.Source == "" && qb.SamplePercent == 0
 }
 
 func GenNewUUID(table string) string {
@@ -0,0 +1,403 @@
+// query.go
+package fsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/Fy-/octypes"
+	"github.com/jmoiron/sqlx/reflectx"
+	"github.com/lib/pq"
+)
+
+// GetStruct runs a single-row query and scans it into a new T via its db tags.
+// It returns (nil, nil) when the query matches no rows.
+func GetStruct[T any](query string, args ...interface{}) (*T, error) {
+	return GetStructContext[T](context.Background(), query, args...)
+}
+
+// GetStructContext is GetStruct with a context
+func GetStructContext[T any](ctx context.Context, query string, args ...interface{}) (*T, error) {
+	var result T
+	err := GetContext(ctx, &result, query, args...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ScanInto scans the first row of query onto the matching fields of an existing dst,
+// leaving fields without a returned column untouched. Columns are matched to fields by
+// their db tags, the same tags InitModelTagCache records. It returns sql.ErrNoRows when
+// the query matches nothing.
+func ScanInto[T any](dst *T, query string, args ...interface{}) error {
+	return ScanIntoContext(context.Background(), dst, query, args...)
+}
+
+// ScanIntoContext is ScanInto with a context
+func ScanIntoContext[T any](ctx context.Context, dst *T, query string, args ...interface{}) (err error) {
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	defer func(start time.Time) { logQuery(ctx, query, args, start, resultRows(dst, err), err) }(time.Now())
+
+	rows, err := Db.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(dst).Elem()
+	traversals := Db.Mapper.TraversalsByName(v.Type(), columns)
+	dests := make([]interface{}, len(columns))
+	for i, traversal := range traversals {
+		if len(traversal) == 0 {
+			return enrichScanError(dst, fmt.Errorf("missing destination name %s in %T", columns[i], dst))
+		}
+		dests[i] = reflectx.FieldByIndexes(v, traversal).Addr().Interface()
+	}
+
+	if err := rows.Scan(dests...); err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+// planList builds the page and count queries of List, sharing their args. With a builder, the
+// filter placeholders follow its args and the WHERE goes ahead of its GROUP BY.
+func planList(qb *QueryBuilder, baseQuery string, t string, filters *Filter, sort *Sort, table string, perPage int, page int) (string, string, []interface{}, error) {
+	var args []interface{}
+	if qb != nil {
+		_, args = qb.BuildWithArgs()
+	}
+	plan, err := planFilterQuery(t, filters, sort, table, perPage, page, len(args)+1)
+	if err != nil {
+		return "", "", nil, err
+	}
+	lock := ""
+	if qb != nil {
+		baseQuery, _ = qb.buildWhere(strings.Join(plan.Conditions, " AND "))
+		plan.Conditions = nil
+		lock = qb.lockingClause()
+	}
+	args = append(args, plan.Args...)
+
+	// The count reuses the plan's conditions without its sort and pagination
+	countPlan := *plan
+	countPlan.OrderBy, countPlan.Limit = nil, 0
+	countQuery := fmt.Sprintf("SELECT COUNT(*) FROM (%s) AS count_subquery", countPlan.SQL(baseQuery))
+	return plan.SQL(baseQuery) + lock, countQuery, args, nil
+}
+
+// FindOne returns the first row of tableName matching filters in sort order, or (nil, nil) when none matches
+func FindOne[T any](tableName, alias string, filters *Filter, sort *Sort) (*T, error) {
+	return FindOneContext[T](context.Background(), tableName, alias, filters, sort)
+}
+
+// FindOneContext is FindOne scoped to the tenant of ctx
+func FindOneContext[T any](ctx context.Context, tableName, alias string, filters *Filter, sort *Sort) (*T, error) {
+	filters, err := scopeFilters(ctx, tableName, filters)
+	if err != nil {
+		return nil, err
+	}
+	qb := SelectBase(tableName, alias)
+	plan, err := PlanFilterQuery(qb.Qualifier(), filters, sort, tableName, 1, 1)
+	if err != nil {
+		return nil, err
+	}
+	return GetStructContext[T](WithQueryTable(ctx, tableName), plan.SQL(qb.Build()), plan.Args...)
+}
+
+// PaginatedResult is a page of rows with its pagination, as returned by List.
+// Data is a plain []T like every generic helper returns, not a pointer to a slice,
+// and List leaves it empty rather than nil when nothing matches.
+type PaginatedResult[T any] struct {
+	Data       []T                `json:"data"`
+	Pagination octypes.Pagination `json:"pagination"`
+}
+
+// MarshalJSON emits an empty Data as [] rather than null
+func (r PaginatedResult[T]) MarshalJSON() ([]byte, error) {
+	type paginatedResult PaginatedResult[T]
+	if r.Data == nil {
+		r.Data = []T{}
+	}
+	return json.Marshal(paginatedResult(r))
+}
+
+// List runs FilterQuery on baseQuery and returns the page of rows with its pagination.
+// When sort is empty the table's default sort from SetDefaultSort is used, and a
+// perPage <= 0 returns every matching row. t must be the qualifier baseQuery gives the
+// table; prefer ListBuilder, which takes it from the builder.
+func List[T any](baseQuery string, t string, filters *Filter, sort *Sort, table string, perPage int, page int) (*PaginatedResult[T], error) {
+	return ListContext[T](context.Background(), baseQuery, t, filters, sort, table, perPage, page)
+}
+
+// ListContext is List scoped to the tenant of ctx
+func ListContext[T any](ctx context.Context, baseQuery string, t string, filters *Filter, sort *Sort, table string, perPage int, page int) (*PaginatedResult[T], error) {
+	return listContext[T](ctx, nil, baseQuery, t, filters, sort, table, perPage, page)
+}
+
+// ListBuilder is List over the builder's query, filtering and sorting its base table under
+// its qualifier, with the builder's own args and locking clause
+func ListBuilder[T any](qb *QueryBuilder, filters *Filter, sort *Sort, perPage int, page int) (*PaginatedResult[T], error) {
+	return ListBuilderContext[T](context.Background(), qb, filters, sort, perPage, page)
+}
+
+// ListBuilderContext is ListBuilder scoped to the tenant of ctx
+func ListBuilderContext[T any](ctx context.Context, qb *QueryBuilder, filters *Filter, sort *Sort, perPage int, page int) (*PaginatedResult[T], error) {
+	return listContext[T](ctx, qb, "", qb.Qualifier(), filters, sort, qb.Table, perPage, page)
+}
+
+func listContext[T any](ctx context.Context, qb *QueryBuilder, baseQuery string, t string, filters *Filter, sort *Sort, table string, perPage int, page int) (*PaginatedResult[T], error) {
+	filters, err := scopeFilters(ctx, table, filters)
+	if err != nil {
+		return nil, err
+	}
+	ctx = WithQueryTable(ctx, table)
+
+	if sort == nil || len(*sort) == 0 {
+		if modelInfo, ok := getModelInfo(table); ok && len(modelInfo.defaultSort) > 0 {
+			sort = &modelInfo.defaultSort
+		}
+	}
+
+	query, countQuery, args, err := planList(qb, baseQuery, t, filters, sort, table, perPage, page)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []T{}
+	err = SelectContext(ctx, &rows, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := GetFilterCountContext(ctx, countQuery, args)
+	if err != nil {
+		return nil, err
+	}
+	// Without pagination (perPage <= 0) every row is on a single page
+	pageMax := 1
+	if perPage > 0 {
+		pageMax = int(math.Ceil(float64(count) / float64(perPage)))
+	}
+	pagination := octypes.Pagination{
+		ResultsPerPage: perPage,
+		PageNo:         page,
+		Count:          count,
+		PageMax:        pageMax,
+	}
+
+	return &PaginatedResult[T]{Data: rows, Pagination: pagination}, nil
+}
+
+// GetByUUID loads the row of tableName whose uuid column is uuid, or (nil, nil) when none matches
+func GetByUUID[T any](tableName string, uuid string) (*T, error) {
+	return GetByUUIDContext[T](context.Background(), tableName, uuid)
+}
+
+// GetByUUIDContext is GetByUUID scoped to the tenant of ctx
+func GetByUUIDContext[T any](ctx context.Context, tableName string, uuid string) (*T, error) {
+	modelInfo, ok := getModelInfo(tableName)
+	if !ok {
+		return nil, fmt.Errorf("table name not initialized: %s", tableName)
+	}
+	fieldName, ok := structFieldFor(modelInfo, "uuid")
+	if !ok {
+		return nil, fmt.Errorf("table %s has no uuid column", tableName)
+	}
+	return FindOneContext[T](ctx, tableName, "", &Filter{fieldName: uuid}, nil)
+}
+
+// GetByUUIDs loads the rows of tableName whose uuid is in uuids with a single query.
+// The result has an entry for every requested UUID, nil when no row was found.
+func GetByUUIDs[T any](tableName string, uuids []string) (map[string]*T, error) {
+	return GetByUUIDsContext[T](context.Background(), tableName, uuids)
+}
+
+// GetByUUIDsContext is GetByUUIDs scoped to the tenant of ctx
+func GetByUUIDsContext[T any](ctx context.Context, tableName string, uuids []string) (map[string]*T, error) {
+	modelInfo, ok := getModelInfo(tableName)
+	if !ok {
+		return nil, fmt.Errorf("table name not initialized: %s", tableName)
+	}
+	fieldName, ok := structFieldFor(modelInfo, "uuid")
+	if !ok {
+		return nil, fmt.Errorf("table %s has no uuid column", tableName)
+	}
+
+	result := make(map[string]*T, len(uuids))
+	for _, uuid := range uuids {
+		result[uuid] = nil
+	}
+	if len(uuids) == 0 {
+		return result, nil
+	}
+
+	rows, err := SelectWhereInContext[T](ctx, tableName, "", "uuid", uuids)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range rows {
+		key, err := fieldString(reflect.ValueOf(&rows[i]).Elem().FieldByName(fieldName))
+		if err != nil {
+			return nil, err
+		}
+		result[key] = &rows[i]
+	}
+	return result, nil
+}
+
+// SelectWhereIn loads the rows of tableName whose column is one of values with a single
+// "column = ANY($1)" query, ordered by the table's default sort.
+func SelectWhereIn[T any](tableName, alias, column string, values []string) ([]T, error) {
+	return SelectWhereInContext[T](context.Background(), tableName, alias, column, values)
+}
+
+// SelectWhereInContext is SelectWhereIn scoped to the tenant of ctx
+func SelectWhereInContext[T any](ctx context.Context, tableName, alias, column string, values []string) ([]T, error) {
+	modelInfo, ok := getModelInfo(tableName)
+	if !ok {
+		return nil, fmt.Errorf("table name not initialized: %s", tableName)
+	}
+	if _, ok := structFieldFor(modelInfo, column); !ok {
+		return nil, fmt.Errorf("invalid column %s for table %s", column, tableName)
+	}
+	rows := []T{}
+	if len(values) == 0 {
+		return rows, nil
+	}
+
+	filters, err := scopeFilters(ctx, tableName, nil)
+	if err != nil {
+		return nil, err
+	}
+	qb := SelectBase(tableName, alias)
+	conditions, args, err := constructConditionsFrom(qb.Qualifier(), filters, tableName, 2)
+	if err != nil {
+		return nil, err
+	}
+	conditions = append([]string{fmt.Sprintf(`%s.%s = ANY($1)`, quoteTable(qb.Qualifier()), QuoteIdentifier(column))}, conditions...)
+	args = append([]interface{}{pq.Array(values)}, args...)
+
+	query := qb.Build() + " WHERE " + strings.Join(conditions, " AND ")
+	orderBy, err := buildOrderBy(qb.Qualifier(), &modelInfo.defaultSort, tableName)
+	if err != nil {
+		return nil, err
+	}
+	if len(orderBy) > 0 {
+		query += " ORDER BY " + strings.Join(orderBy, ", ")
+	}
+
+	if err := SelectContext(WithQueryTable(ctx, tableName), &rows, query, args...); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// LoadChildren batch-loads the rows of childTable whose fkColumn references one of parents
+// with a single query, then calls assign once per parent with its children (possibly none).
+// It avoids N+1 queries for one-to-many relations that a join would multiply.
+func LoadChildren[P, C any](parents []P, parentKey func(P) string, childTable, fkColumn string, assign func(*P, []C)) error {
+	return LoadChildrenContext(context.Background(), parents, parentKey, childTable, fkColumn, assign)
+}
+
+// LoadChildrenContext is LoadChildren with the children scoped to the tenant of ctx
+func LoadChildrenContext[P, C any](ctx context.Context, parents []P, parentKey func(P) string, childTable, fkColumn string, assign func(*P, []C)) error {
+	if len(parents) == 0 {
+		return nil
+	}
+	modelInfo, ok := getModelInfo(childTable)
+	if !ok {
+		return fmt.Errorf("table name not initialized: %s", childTable)
+	}
+	fieldName, ok := structFieldFor(modelInfo, fkColumn)
+	if !ok {
+		return fmt.Errorf("invalid column %s for table %s", fkColumn, childTable)
+	}
+
+	keys := []string{}
+	seen := make(map[string]struct{}, len(parents))
+	for _, parent := range parents {
+		key := parentKey(parent)
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+
+	rows, err := SelectWhereInContext[C](ctx, childTable, "", fkColumn, keys)
+	if err != nil {
+		return err
+	}
+
+	children := make(map[string][]C, len(keys))
+	for i := range rows {
+		key, err := fieldString(reflect.ValueOf(&rows[i]).Elem().FieldByName(fieldName))
+		if err != nil {
+			return err
+		}
+		children[key] = append(children[key], rows[i])
+	}
+	for i := range parents {
+		assign(&parents[i], children[parentKey(parents[i])])
+	}
+	return nil
+}
+
+// structFieldFor returns the struct field name mapped to a db column
+func structFieldFor(modelInfo *modelInfo, column string) (string, bool) {
+	for fieldName, dbField := range modelInfo.dbTagMap {
+		if dbField == column {
+			return fieldName, true
+		}
+	}
+	return "", false
+}
+
+// fieldString renders a scanned key field (string, Valuer or other scalar) as a string
+func fieldString(v reflect.Value) (string, error) {
+	if valuer, ok := v.Interface().(driver.Valuer); ok {
+		value, err := valuer.Value()
+		if err != nil {
+			return "", err
+		}
+		if value == nil {
+			return "", nil
+		}
+		if b, ok := value.([]byte); ok {
+			return string(b), nil
+		}
+		return fmt.Sprint(value), nil
+	}
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "", nil
+		}
+		v = v.Elem()
+	}
+	return fmt.Sprint(v.Interface()), nil
+}
@@ -0,0 +1,175 @@
+// schema.go
+package fsql
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// packageTypes maps the column types of this package. Money gets a scale of 2 so numeric
+// values always scan back as whole cents.
+var packageTypes = map[reflect.Type]string{
+	reflect.TypeOf(NullBytes{}):    "bytea",
+	reflect.TypeOf(Float64Array{}): "double precision[]",
+	reflect.TypeOf(HStore{}):       "hstore",
+	reflect.TypeOf(Money(0)):       "numeric(20,2)",
+}
+
+// GenerateCreateTable returns a best-effort CREATE TABLE scaffold for a registered model.
+// Column types are inferred from the Go field types; constraints and indexes are not emitted.
+func GenerateCreateTable(tableName string) string {
+	modelInfo, ok := getModelInfo(tableName)
+	if !ok {
+		panic("table name not initialized: " + tableName)
+	}
+
+	columns := []string{}
+	for _, fieldName := range modelInfo.dbFieldsSelect {
+		column := QuoteIdentifier(fieldName) + " "
+		fieldType := modelInfo.dbFieldTypes[fieldName]
+		if sqlType, ok := sqlTypeFor(fieldType); ok {
+			column += sqlType
+		} else {
+			column += fmt.Sprintf("/* TODO: type for %s */", fieldType)
+		}
+
+		if defVal, ok := modelInfo.dbInsertValueMap[fieldName]; ok {
+			switch defVal {
+			case "NULL", "DEFAULT":
+			case "NOW()", "true", "false":
+				column += " DEFAULT " + defVal
+			default:
+				column += " DEFAULT '" + strings.ReplaceAll(defVal, `'`, `''`) + "'"
+			}
+		}
+		columns = append(columns, column)
+	}
+
+	return fmt.Sprintf("CREATE TABLE %s (\n    %s\n);", quoteTable(tableName), strings.Join(columns, ",\n    "))
+}
+
+func sqlTypeFor(t reflect.Type) (string, bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return "timestamptz", true
+	}
+	if sqlType, ok := packageTypes[t]; ok {
+		return sqlType, true
+	}
+
+	if strings.HasSuffix(t.PkgPath(), "octypes") {
+		switch t.Name() {
+		case "NullString":
+			return "text", true
+		case "NullInt64":
+			return "bigint", true
+		case "NullInt32":
+			return "integer", true
+		case "NullInt16":
+			return "smallint", true
+		case "NullFloat64":
+			return "double precision", true
+		case "NullBool":
+			return "boolean", true
+		case "NullTime", "CustomTime":
+			return "timestamptz", true
+		}
+		return "", false
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return "text", true
+	case reflect.Int, reflect.Int64:
+		return "bigint", true
+	case reflect.Int32:
+		return "integer", true
+	case reflect.Int16, reflect.Int8:
+		return "smallint", true
+	case reflect.Float64:
+		return "double precision", true
+	case reflect.Float32:
+		return "real", true
+	case reflect.Bool:
+		return "boolean", true
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytea", true
+		}
+	}
+	return "", false
+}
+
+// VerifySchema checks that every column of the registered model exists in the database table.
+func VerifySchema(tableName string) error {
+	return verifySchema(tableName, false)
+}
+
+// VerifySchemaStrict is VerifySchema that also rejects table columns the model doesn't declare.
+func VerifySchemaStrict(tableName string) error {
+	return verifySchema(tableName, true)
+}
+
+func verifySchema(tableName string, strict bool) error {
+	modelInfo, ok := getModelInfo(tableName)
+	if !ok {
+		return fmt.Errorf("table name not initialized: %s", tableName)
+	}
+
+	schema, table := "", tableName
+	if i := strings.LastIndex(tableName, "."); i >= 0 {
+		schema, table = tableName[:i], tableName[i+1:]
+	}
+
+	var columns []string
+	err := SelectContext(WithQueryTable(context.Background(), tableName), &columns, `SELECT column_name FROM information_schema.columns WHERE table_schema = COALESCE(NULLIF($1, ''), current_schema()) AND table_name = $2`, schema, table)
+	if err != nil {
+		return err
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf("table %s does not exist", tableName)
+	}
+
+	existing := make(map[string]struct{}, len(columns))
+	for _, column := range columns {
+		existing[column] = struct{}{}
+	}
+
+	var missing []string
+	for _, fieldName := range modelInfo.dbFieldsSelect {
+		if _, ok := existing[fieldName]; !ok {
+			missing = append(missing, fieldName)
+		}
+	}
+
+	var extra []string
+	if strict {
+		for _, column := range columns {
+			if _, ok := modelInfo.dbFieldsSelectMap[column]; !ok {
+				extra = append(extra, column)
+			}
+		}
+		sort.Strings(extra)
+	}
+
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "missing columns: "+strings.Join(missing, ", "))
+	}
+	if len(extra) > 0 {
+		problems = append(problems, "unmodeled columns: "+strings.Join(extra, ", "))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("schema mismatch for table %s: %s", tableName, strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+// stmtcache.go
+package fsql
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/soulkyn-ai/nyxutils"
+)
+
+// MaxCachedStatements bounds the prepared statement cache. When it is exceeded the least
+// recently used statement is closed, so dynamically built filter queries can't grow it
+// without limit. Zero disables the cache and the Prepared helpers prepare every time.
+var MaxCachedStatements = 256
+
+type cachedStmt struct {
+	stmt    *sqlx.Stmt
+	elem    *list.Element
+	refs    int  // callers currently using stmt
+	evicted bool // closed by the last release once refs drops to zero
+}
+
+var (
+	stmtCache = nyxutils.NewSafeMap[*cachedStmt]()
+	stmtLRU   = list.New() // front is most recently used, values are cache keys
+	stmtMu    sync.Mutex
+)
+
+func stmtKey(query string) string {
+	return Db.DriverName() + ":" + query
+}
+
+// preparedStmt returns the cached statement for query, preparing it on first use.
+// The returned release func must be called once the statement is no longer used.
+func preparedStmt(ctx context.Context, query string) (*sqlx.Stmt, func(), error) {
+	if MaxCachedStatements <= 0 {
+		stmt, err := Db.PreparexContext(ctx, query)
+		if err != nil {
+			return nil, nil, err
+		}
+		return stmt, func() { stmt.Close() }, nil
+	}
+
+	key := stmtKey(query)
+	stmtMu.Lock()
+	if cached, ok := stmtCache.Get(key); ok {
+		defer stmtMu.Unlock()
+		return acquireStmt(cached), func() { releaseStmt(cached) }, nil
+	}
+	stmtMu.Unlock()
+
+	stmt, err := Db.PreparexContext(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stmtMu.Lock()
+	defer stmtMu.Unlock()
+	cached, ok := stmtCache.Get(key)
+	if ok {
+		// Prepared concurrently by another caller, keep theirs
+		stmt.Close()
+	} else {
+		cached = &cachedStmt{stmt: stmt, elem: stmtLRU.PushFront(key)}
+		stmtCache.Set(key, cached)
+	}
+	acquireStmt(cached)
+	for stmtLRU.Len() > MaxCachedStatements {
+		evictStmt(stmtLRU.Back())
+	}
+	return cached.stmt, func() { releaseStmt(cached) }, nil
+}
+
+// acquireStmt must be called with stmtMu held
+func acquireStmt(cached *cachedStmt) *sqlx.Stmt {
+	cached.refs++
+	stmtLRU.MoveToFront(cached.elem)
+	return cached.stmt
+}
+
+func releaseStmt(cached *cachedStmt) {
+	stmtMu.Lock()
+	defer stmtMu.Unlock()
+	cached.refs--
+	if cached.evicted && cached.refs == 0 {
+		cached.stmt.Close()
+	}
+}
+
+// evictStmt must be called with stmtMu held. A statement still in use is closed
+// by its last release instead.
+func evictStmt(elem *list.Element) {
+	key := elem.Value.(string)
+	stmtLRU.Remove(elem)
+	cached, ok := stmtCache.Get(key)
+	if !ok {
+		return
+	}
+	stmtCache.Delete(key)
+	cached.evicted = true
+	if cached.refs == 0 {
+		cached.stmt.Close()
+	}
+}
+
+// ClearStatementCache closes and forgets every cached prepared statement
+func ClearStatementCache() {
+	stmtMu.Lock()
+	defer stmtMu.Unlock()
+	for stmtLRU.Len() > 0 {
+		evictStmt(stmtLRU.Back())
+	}
+}
+
+// PreparedExecContext is ExecContext through the prepared statement cache
+func PreparedExecContext(ctx context.Context, query string, args ...interface{}) (result sql.Result, err error) {
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	defer func(start time.Time) { logQuery(ctx, query, args, start, affectedRows(result, err), err) }(time.Now())
+	stmt, release, err := preparedStmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return stmt.ExecContext(ctx, args...)
+}
+
+// PreparedGetContext is GetContext through the prepared statement cache
+func PreparedGetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) (err error) {
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	defer func(start time.Time) { logQuery(ctx, query, args, start, resultRows(dest, err), err) }(time.Now())
+	stmt, release, err := preparedStmt(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return stmt.GetContext(ctx, dest, args...)
+}
+
+// PreparedSelectContext is SelectContext through the prepared statement cache
+func PreparedSelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) (err error) {
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	defer func(start time.Time) { logQuery(ctx, query, args, start, resultRows(dest, err), err) }(time.Now())
+	stmt, release, err := preparedStmt(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return stmt.SelectContext(ctx, dest, args...)
+}
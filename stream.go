@@ -0,0 +1,78 @@
+// stream.go
+package fsql
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// Iterate is IterateContext with a background context
+func Iterate[T any](fn func(*T) error, query string, args ...interface{}) error {
+	return IterateContext[T](context.Background(), fn, query, args...)
+}
+
+// IterateContext scans the rows of query one at a time and calls fn for each, without
+// loading the whole result in memory. It stops at the first error returned by fn, and
+// when ctx is cancelled it closes the rows and returns ctx.Err() before the next row.
+func IterateContext[T any](ctx context.Context, fn func(*T) error, query string, args ...interface{}) (err error) {
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+
+	var count int64
+	defer func(start time.Time) { logQuery(ctx, query, args, start, count, err) }(time.Now())
+
+	rows, err := Db.QueryxContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		count++
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var item T
+		if err := rows.StructScan(&item); err != nil {
+			return err
+		}
+		if err := fn(&item); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return rows.Err()
+}
+
+// StreamJSON is StreamJSONContext with a background context
+func StreamJSON[T any](w io.Writer, query string, args ...interface{}) error {
+	return StreamJSONContext[T](context.Background(), w, query, args...)
+}
+
+// StreamJSONContext writes the rows of query to w as a JSON array, encoding each row as it is
+// scanned so the result set is never held in memory. On error the array is left unterminated.
+func StreamJSONContext[T any](ctx context.Context, w io.Writer, query string, args ...interface{}) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	first := true
+	err := IterateContext(ctx, func(row *T) error {
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+		return enc.Encode(row)
+	}, query, args...)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "]")
+	return err
+}
@@ -0,0 +1,66 @@
+// tenant.go
+package fsql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrNoTenant is returned when a tenant-scoped table is queried without a tenant in the context
+var ErrNoTenant = errors.New("no tenant in context")
+
+type tenantContextKey struct{}
+type tenantBypassContextKey struct{}
+
+// WithTenant scopes the list/get/count and write helpers run with ctx to tenantID
+func WithTenant(ctx context.Context, tenantID interface{}) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenantID)
+}
+
+// WithoutTenant explicitly disables tenant scoping for ctx, for admin queries across tenants
+func WithoutTenant(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tenantBypassContextKey{}, true)
+}
+
+// TenantFromContext returns the tenant set by WithTenant
+func TenantFromContext(ctx context.Context) (interface{}, bool) {
+	tenantID := ctx.Value(tenantContextKey{})
+	return tenantID, tenantID != nil
+}
+
+// scopeFilters adds the tenant condition of a dbMode:"tenant" table to a copy of filters.
+// It fails with ErrNoTenant rather than returning every tenant's rows.
+func scopeFilters(ctx context.Context, table string, filters *Filter) (*Filter, error) {
+	modelInfo, ok := getModelInfo(table)
+	if !ok || modelInfo.tenantField == "" {
+		return filters, nil
+	}
+	if bypass, _ := ctx.Value(tenantBypassContextKey{}).(bool); bypass {
+		return filters, nil
+	}
+
+	tenantID, ok := TenantFromContext(ctx)
+	if !ok {
+		return nil, fmt.Errorf("%w for table %s", ErrNoTenant, table)
+	}
+
+	scoped := Filter{}
+	if filters != nil {
+		for k, v := range *filters {
+			scoped[k] = v
+		}
+	}
+	scoped[modelInfo.tenantField] = tenantID
+	return &scoped, nil
+}
+
+// tenantConditions renders the tenant condition of ctx for a write to table, numbering its
+// placeholder from argStart. It returns none for tables without a tenant column.
+func tenantConditions(ctx context.Context, table string, argStart int) ([]string, []interface{}, error) {
+	filters, err := scopeFilters(ctx, table, nil)
+	if err != nil || filters == nil {
+		return nil, nil, err
+	}
+	return constructConditionsFrom(table, filters, table, argStart)
+}
@@ -0,0 +1,95 @@
+// tx.go
+package fsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// SerializationRetryBackoff is the wait before the first retry of WithSerializableTransaction,
+// doubled on every following retry
+var SerializationRetryBackoff = 10 * time.Millisecond
+
+// WithTransaction runs fn in a transaction, committing when it returns nil and rolling back
+// when it returns an error or panics (the panic is then re-raised).
+func WithTransaction(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	return withTransaction(ctx, nil, fn)
+}
+
+// WithSerializableTransaction runs fn in a SERIALIZABLE transaction like WithTransaction, and
+// re-runs the whole transaction up to maxRetries times, with a growing backoff, when it fails
+// with a serialization failure (40001) or a deadlock (40P01). fn must be safe to run again.
+func WithSerializableTransaction(ctx context.Context, maxRetries int, fn func(tx *sqlx.Tx) error) error {
+	backoff := SerializationRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := withTransaction(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable}, fn)
+		if err == nil || attempt >= maxRetries || !isSerializationFailure(err) {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// isSerializationFailure reports whether err is a PostgreSQL error worth retrying the transaction for
+func isSerializationFailure(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && (pqErr.Code == "40001" || pqErr.Code == "40P01")
+}
+
+func withTransaction(ctx context.Context, opts *sql.TxOptions, fn func(tx *sqlx.Tx) error) (err error) {
+	tx, err := Db.BeginTxx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rbErr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeferConstraints defers the checks of every deferrable constraint to the commit of tx.
+// Only constraints declared DEFERRABLE in the schema are affected; others are still
+// checked immediately.
+func DeferConstraints(tx *sqlx.Tx) error {
+	_, err := tx.Exec(`SET CONSTRAINTS ALL DEFERRED`)
+	return err
+}
+
+// DeferConstraintsNamed is DeferConstraints for the named constraints only,
+// each of which must be declared DEFERRABLE.
+func DeferConstraintsNamed(tx *sqlx.Tx, names ...string) error {
+	if len(names) == 0 {
+		return fmt.Errorf("no constraints to defer")
+	}
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = quoteTable(name)
+	}
+	_, err := tx.Exec(`SET CONSTRAINTS ` + strings.Join(quoted, ", ") + ` DEFERRED`)
+	return err
+}
@@ -0,0 +1,251 @@
+// types.go
+package fsql
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx/reflectx"
+	"github.com/lib/pq"
+	"github.com/lib/pq/hstore"
+)
+
+// HStore maps a Postgres hstore column. A nil value is a NULL entry and marshals to JSON null.
+type HStore map[string]*string
+
+func (h *HStore) Scan(value interface{}) error {
+	var hs hstore.Hstore
+	if err := hs.Scan(value); err != nil {
+		return err
+	}
+	if hs.Map == nil {
+		*h = nil
+		return nil
+	}
+
+	result := make(HStore, len(hs.Map))
+	for k, v := range hs.Map {
+		if v.Valid {
+			s := v.String
+			result[k] = &s
+		} else {
+			result[k] = nil
+		}
+	}
+	*h = result
+	return nil
+}
+
+func (h HStore) Value() (driver.Value, error) {
+	if h == nil {
+		return nil, nil
+	}
+
+	hs := hstore.Hstore{Map: make(map[string]sql.NullString, len(h))}
+	for k, v := range h {
+		if v != nil {
+			hs.Map[k] = sql.NullString{String: *v, Valid: true}
+		} else {
+			hs.Map[k] = sql.NullString{}
+		}
+	}
+	return hs.Value()
+}
+
+// Float64Array maps numeric[]/double precision[] columns. A NULL array scans to nil and marshals to JSON null.
+type Float64Array []float64
+
+func (a *Float64Array) Scan(value interface{}) error {
+	var arr pq.Float64Array
+	if err := arr.Scan(value); err != nil {
+		return err
+	}
+	*a = Float64Array(arr)
+	return nil
+}
+
+func (a Float64Array) Value() (driver.Value, error) {
+	return pq.Float64Array(a).Value()
+}
+
+// NullBytes maps a nullable bytea column and transports it over JSON as base64.
+// Valid distinguishes NULL from an empty value.
+type NullBytes struct {
+	Bytes []byte
+	Valid bool
+}
+
+func (nb *NullBytes) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		nb.Bytes, nb.Valid = nil, false
+	case []byte:
+		nb.Bytes, nb.Valid = append([]byte{}, v...), true
+	default:
+		return fmt.Errorf("cannot scan %T into NullBytes", value)
+	}
+	return nil
+}
+
+func (nb NullBytes) Value() (driver.Value, error) {
+	if !nb.Valid {
+		return nil, nil
+	}
+	if nb.Bytes == nil {
+		return []byte{}, nil
+	}
+	return nb.Bytes, nil
+}
+
+func (nb NullBytes) MarshalJSON() ([]byte, error) {
+	if !nb.Valid {
+		return []byte("null"), nil
+	}
+	if nb.Bytes == nil {
+		return []byte(`""`), nil
+	}
+	return json.Marshal(nb.Bytes)
+}
+
+func (nb *NullBytes) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		nb.Bytes, nb.Valid = nil, false
+		return nil
+	}
+	var b []byte
+	if err := json.Unmarshal(data, &b); err != nil {
+		return err
+	}
+	if b == nil {
+		b = []byte{}
+	}
+	nb.Bytes, nb.Valid = b, true
+	return nil
+}
+
+// Money maps a Postgres money column as an amount of cents. Scanning parses the locale-formatted
+// output ("$1,234.56", "-$1,234.56" or "($1,234.56)") assuming a "." decimal separator, and
+// Value sends a plain decimal string. It marshals to JSON as its integer number of cents.
+type Money int64
+
+func (m *Money) Scan(value interface{}) error {
+	var s string
+	switch v := value.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case nil:
+		return fmt.Errorf("cannot scan NULL into Money")
+	default:
+		return fmt.Errorf("cannot scan %T into Money", value)
+	}
+
+	cents, err := parseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = Money(cents)
+	return nil
+}
+
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// String formats the amount as a plain decimal such as "-1234.56"
+func (m Money) String() string {
+	cents := int64(m)
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+func parseMoney(s string) (int64, error) {
+	negative := strings.Contains(s, "-") || (strings.HasPrefix(strings.TrimSpace(s), "(") && strings.HasSuffix(strings.TrimSpace(s), ")"))
+
+	var whole, fraction strings.Builder
+	inFraction := false
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			if inFraction {
+				fraction.WriteRune(r)
+			} else {
+				whole.WriteRune(r)
+			}
+		case r == '.':
+			if inFraction {
+				return 0, fmt.Errorf("invalid money value %q", s)
+			}
+			inFraction = true
+		}
+	}
+	if whole.Len() == 0 && fraction.Len() == 0 {
+		return 0, fmt.Errorf("invalid money value %q", s)
+	}
+
+	digits := fraction.String()
+	if len(digits) > 2 {
+		return 0, fmt.Errorf("invalid money value %q", s)
+	}
+	digits += strings.Repeat("0", 2-len(digits))
+
+	cents, err := strconv.ParseInt(whole.String()+digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid money value %q: %w", s, err)
+	}
+	if negative {
+		cents = -cents
+	}
+	return cents, nil
+}
+
+// JSONSlice scans a JSON array of objects keyed by column, as selected by SelectJSONAgg,
+// matching the keys to the db tags of T. A NULL array scans to nil.
+type JSONSlice[T any] []T
+
+var jsonSliceMapper = reflectx.NewMapperFunc("db", strings.ToLower)
+
+func (s *JSONSlice[T]) Scan(value interface{}) error {
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		*s = nil
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return fmt.Errorf("cannot scan %T into JSONSlice", value)
+	}
+
+	var objects []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &objects); err != nil {
+		return err
+	}
+	result := make(JSONSlice[T], len(objects))
+	for i, object := range objects {
+		v := reflect.ValueOf(&result[i]).Elem()
+		for column, raw := range object {
+			field := jsonSliceMapper.FieldByName(v, column)
+			if !field.IsValid() {
+				continue
+			}
+			if err := json.Unmarshal(raw, field.Addr().Interface()); err != nil {
+				return fmt.Errorf("column %s: %w", column, err)
+			}
+		}
+	}
+	*s = result
+	return nil
+}
@@ -0,0 +1,295 @@
+// upsert.go
+package fsql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ConflictTarget is the ON CONFLICT target of an upsert: either a column list
+// or the name of a unique constraint.
+type ConflictTarget struct {
+	Columns    []string
+	Constraint string
+
+	// Predicate is the trusted WHERE of a partial unique index, e.g. "deleted_at IS NULL"
+	Predicate string
+}
+
+// ConflictColumns targets the unique index over columns. Rows whose target columns are NULL
+// only conflict when that index is declared NULLS NOT DISTINCT, which requires PostgreSQL 15+;
+// with a plain unique index they never conflict and each upsert inserts a new row.
+func ConflictColumns(columns ...string) ConflictTarget {
+	return ConflictTarget{Columns: columns}
+}
+
+// ConflictConstraint targets a named unique constraint
+func ConflictConstraint(name string) ConflictTarget {
+	return ConflictTarget{Constraint: name}
+}
+
+// Where sets the predicate of the partial unique index targeted by the columns,
+// which ON CONFLICT requires to match such an index
+func (ct ConflictTarget) Where(predicate string) ConflictTarget {
+	ct.Predicate = predicate
+	return ct
+}
+
+func (ct ConflictTarget) sql() (string, error) {
+	if ct.Constraint != "" {
+		if len(ct.Columns) > 0 {
+			return "", fmt.Errorf("conflict target has both columns and a constraint")
+		}
+		if ct.Predicate != "" {
+			return "", fmt.Errorf("conflict target predicate requires columns, not a constraint")
+		}
+		return `ON CONSTRAINT ` + QuoteIdentifier(ct.Constraint), nil
+	}
+	if len(ct.Columns) == 0 {
+		return "", fmt.Errorf("empty conflict target")
+	}
+	quoted := make([]string, len(ct.Columns))
+	for i, column := range ct.Columns {
+		quoted[i] = QuoteIdentifier(column)
+	}
+	target := "(" + strings.Join(quoted, ",") + ")"
+	if ct.Predicate != "" {
+		target += " WHERE " + ct.Predicate
+	}
+	return target, nil
+}
+
+// GetUpsertQuery builds an INSERT ... ON CONFLICT that updates the update fields present in valuesMap
+// from the proposed row, or does nothing when there are none.
+func GetUpsertQuery(tableName string, valuesMap map[string]interface{}, target ConflictTarget, returning string) (string, []interface{}, error) {
+	conflict, err := target.sql()
+	if err != nil {
+		return "", nil, err
+	}
+	_, fields, err := getFieldsByModeE(tableName, "update", "", ".")
+	if err != nil {
+		return "", nil, err
+	}
+	if len(returning) > 0 {
+		if err := validateReturning(tableName, returning); err != nil {
+			return "", nil, err
+		}
+	}
+
+	conflictColumns := make(map[string]struct{}, len(target.Columns))
+	for _, column := range target.Columns {
+		conflictColumns[column] = struct{}{}
+	}
+
+	setClauses := []string{}
+	for _, field := range fields {
+		if _, ok := valuesMap[field]; !ok {
+			continue
+		}
+		if _, ok := conflictColumns[field]; ok {
+			continue
+		}
+		setClauses = append(setClauses, fmt.Sprintf(`%s = EXCLUDED.%s`, QuoteIdentifier(field), QuoteIdentifier(field)))
+	}
+
+	query, queryValues := GetInsertQuery(tableName, valuesMap, "")
+	if len(setClauses) > 0 {
+		query += fmt.Sprintf(" ON CONFLICT %s DO UPDATE SET %s", conflict, strings.Join(setClauses, ", "))
+	} else {
+		query += fmt.Sprintf(" ON CONFLICT %s DO NOTHING", conflict)
+	}
+	if len(returning) > 0 {
+		query += fmt.Sprintf(` RETURNING %s.%s`, quoteTable(tableName), QuoteIdentifier(returning))
+	}
+	return query, queryValues, nil
+}
+
+// Upsert inserts valuesMap or updates the conflicting row like GetUpsertQuery, scans the
+// returning columns of the resulting row into dest, a pointer to a struct, and reports
+// whether the row was inserted rather than updated. At least one update field must be
+// present in valuesMap so a conflict always returns the updated row.
+//
+// Insert and update are told apart with RETURNING (xmax = 0): a freshly inserted row version
+// has no deleting transaction yet, while the update of a conflicting row sets xmax. This relies on
+// PostgreSQL internals rather than a documented guarantee, but is the established idiom.
+func Upsert(tableName string, valuesMap map[string]interface{}, target ConflictTarget, returning []string, dest interface{}) (inserted bool, err error) {
+	query, queryValues, err := getUpsertReturningQuery(tableName, valuesMap, target, returning)
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := withDefaultTimeout(WithQueryTable(context.Background(), tableName))
+	defer cancel()
+	defer func(start time.Time) { logQuery(ctx, query, queryValues, start, resultRows(dest, err), err) }(time.Now())
+
+	// Unsafe lets StructScan skip the inserted column, which is then read by a second Scan of the row
+	rows, err := Db.Unsafe().QueryxContext(ctx, query, queryValues...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return false, err
+		}
+		return false, sql.ErrNoRows
+	}
+	if err := rows.StructScan(dest); err != nil {
+		return false, err
+	}
+	columns := make([]interface{}, len(returning)+1)
+	for i := range returning {
+		columns[i] = new(interface{})
+	}
+	columns[len(returning)] = &inserted
+	if err := rows.Scan(columns...); err != nil {
+		return false, err
+	}
+	return inserted, rows.Close()
+}
+
+func getUpsertReturningQuery(tableName string, valuesMap map[string]interface{}, target ConflictTarget, returning []string) (string, []interface{}, error) {
+	clause, err := returningClause(tableName, returning, ReturningExpr{Expr: "(xmax = 0)", Alias: "inserted"})
+	if err != nil {
+		return "", nil, err
+	}
+	query, queryValues, err := GetUpsertQuery(tableName, valuesMap, target, "")
+	if err != nil {
+		return "", nil, err
+	}
+	if strings.HasSuffix(query, " DO NOTHING") {
+		return "", nil, fmt.Errorf("upsert on %s has no field to update", tableName)
+	}
+	return query + clause, queryValues, nil
+}
+
+// InsertIdempotent inserts the row unless one with the same idempotencyCol value already exists.
+// The returning column of the new or existing row is scanned into dest, and created reports
+// whether the row was inserted by this call.
+func InsertIdempotent(tableName string, valuesMap map[string]interface{}, idempotencyCol string, returning string, dest interface{}) (bool, error) {
+	key, ok := valuesMap[idempotencyCol]
+	if !ok {
+		return false, fmt.Errorf("idempotency column %s not found in valuesMap", idempotencyCol)
+	}
+	if err := validateReturning(tableName, returning); err != nil {
+		return false, err
+	}
+
+	query, queryValues := GetInsertQuery(tableName, valuesMap, "")
+	query += fmt.Sprintf(` ON CONFLICT (%s) DO NOTHING RETURNING %s.%s`, QuoteIdentifier(idempotencyCol), quoteTable(tableName), QuoteIdentifier(returning))
+
+	ctx := WithQueryTable(context.Background(), tableName)
+	err := GetContext(ctx, dest, query, queryValues...)
+	if err == nil {
+		return true, nil
+	}
+	if err != sql.ErrNoRows {
+		return false, err
+	}
+
+	quotedTableName := quoteTable(tableName)
+	query = fmt.Sprintf(`SELECT %s.%s FROM %s WHERE %s.%s = $1 LIMIT 1`, quotedTableName, QuoteIdentifier(returning), quotedTableName, quotedTableName, QuoteIdentifier(idempotencyCol))
+	if err := GetContext(ctx, dest, query, key); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// ConflictAction is how InsertOrResolve recovers from a unique violation
+type ConflictAction int
+
+const (
+	// ConflictSelect returns the existing row
+	ConflictSelect ConflictAction = iota
+	// ConflictUpdate updates the existing row with the update fields present in valuesMap
+	ConflictUpdate
+)
+
+// ConflictResolution identifies the row conflicting on a unique constraint by Columns,
+// read from valuesMap, and tells InsertOrResolve what to do with it
+type ConflictResolution struct {
+	Columns []string
+	Action  ConflictAction
+}
+
+// InsertOrResolve inserts valuesMap and scans the returning column into dest. When the insert
+// violates one of several unique constraints, which a single ON CONFLICT can't target, the
+// violated constraint is looked up in resolutions (keyed by constraint name) to select or update
+// the existing row instead; created is false then. A violation of a constraint missing from
+// resolutions is returned as is.
+func InsertOrResolve(tableName string, valuesMap map[string]interface{}, resolutions map[string]ConflictResolution, returning string, dest interface{}) (created bool, err error) {
+	if err := validateReturning(tableName, returning); err != nil {
+		return false, err
+	}
+	ctx := WithQueryTable(context.Background(), tableName)
+
+	query, queryValues := GetInsertQuery(tableName, valuesMap, returning)
+	err = GetContext(ctx, dest, query, queryValues...)
+	var pqErr *pq.Error
+	if err == nil || !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+		return err == nil, err
+	}
+	resolution, ok := resolutions[pqErr.Constraint]
+	if !ok {
+		return false, err
+	}
+
+	query, queryValues, err = getResolveQuery(tableName, valuesMap, resolution, returning)
+	if err != nil {
+		return false, err
+	}
+	return false, GetContext(ctx, dest, query, queryValues...)
+}
+
+// getResolveQuery builds the SELECT or UPDATE of the row matching the resolution columns.
+// An update without update fields in valuesMap selects the row.
+func getResolveQuery(tableName string, valuesMap map[string]interface{}, resolution ConflictResolution, returning string) (string, []interface{}, error) {
+	if len(resolution.Columns) == 0 {
+		return "", nil, fmt.Errorf("conflict resolution on %s has no columns", tableName)
+	}
+	modelInfo, ok := getModelInfo(tableName)
+	if !ok {
+		return "", nil, fmt.Errorf("table name not initialized: %s", tableName)
+	}
+	quotedTableName := quoteTable(tableName)
+
+	setClauses := []string{}
+	queryValues := []interface{}{}
+	if resolution.Action == ConflictUpdate {
+		keyColumns := make(map[string]struct{}, len(resolution.Columns))
+		for _, column := range resolution.Columns {
+			keyColumns[column] = struct{}{}
+		}
+		for _, field := range modelInfo.dbFieldsUpdate {
+			value, ok := valuesMap[field]
+			if _, isKey := keyColumns[field]; !ok || isKey {
+				continue
+			}
+			queryValues = append(queryValues, value)
+			setClauses = append(setClauses, fmt.Sprintf(`%s = %s`, QuoteIdentifier(field), castPlaceholder(modelInfo, field, len(queryValues))))
+		}
+	}
+
+	conditions := make([]string, len(resolution.Columns))
+	for i, column := range resolution.Columns {
+		value, ok := valuesMap[column]
+		if !ok {
+			return "", nil, fmt.Errorf("conflict column %s not found in valuesMap", column)
+		}
+		queryValues = append(queryValues, value)
+		conditions[i] = fmt.Sprintf(`%s.%s = %s`, quotedTableName, QuoteIdentifier(column), castPlaceholder(modelInfo, column, len(queryValues)))
+	}
+
+	if len(setClauses) > 0 {
+		return fmt.Sprintf(`UPDATE %s SET %s WHERE %s RETURNING %s.%s`, quotedTableName, strings.Join(setClauses, ", "),
+			strings.Join(conditions, " AND "), quotedTableName, QuoteIdentifier(returning)), queryValues, nil
+	}
+	return fmt.Sprintf(`SELECT %s.%s FROM %s WHERE %s LIMIT 1`, quotedTableName, QuoteIdentifier(returning), quotedTableName,
+		strings.Join(conditions, " AND ")), queryValues, nil
+}
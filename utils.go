@@ -3,6 +3,7 @@ package fsql
 
 import (
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 )
@@ -37,6 +38,34 @@ func StrListToStrComma(list []string) string {
 	return strings.Join(list, ",")
 }
 
+// LowercaseIdentifiers folds every table, column and alias name to lowercase before quoting,
+// matching how PostgreSQL treats unquoted identifiers, so db:"MyColumn" targets column mycolumn.
+// Set it before InitDB, which then also lowercases db tags when scanning. Off by default.
+var LowercaseIdentifiers = false
+
+// foldIdent applies LowercaseIdentifiers to an identifier
+func foldIdent(name string) string {
+	if LowercaseIdentifiers {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// QuoteIdentifier quotes a single identifier for raw SQL, escaping embedded double quotes
+// by doubling them as SQL requires
+func QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(foldIdent(name), `"`, `""`) + `"`
+}
+
+// quoteTable quotes each part of a possibly schema-qualified table name ("schema"."table")
+func quoteTable(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
 func Placeholders(start, count int) []string {
 	placeholders := make([]string, count)
 	for i := 0; i < count; i++ {
@@ -44,3 +73,38 @@ func Placeholders(start, count int) []string {
 	}
 	return placeholders
 }
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// EscapeLike escapes the LIKE wildcards in s so it matches literally
+func EscapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// LikePrefix builds a LIKE pattern matching values starting with s
+func LikePrefix(s string) string {
+	return EscapeLike(s) + "%"
+}
+
+// LikeSuffix builds a LIKE pattern matching values ending with s
+func LikeSuffix(s string) string {
+	return "%" + EscapeLike(s)
+}
+
+// LikeContains builds a LIKE pattern matching values containing s
+func LikeContains(s string) string {
+	return "%" + EscapeLike(s) + "%"
+}
+
+var rePlaceholder = regexp.MustCompile(`\$(\d+)`)
+
+// shiftPlaceholders renumbers the $n placeholders of query by offset
+func shiftPlaceholders(query string, offset int) string {
+	if offset == 0 {
+		return query
+	}
+	return rePlaceholder.ReplaceAllStringFunc(query, func(placeholder string) string {
+		n, _ := strconv.Atoi(placeholder[1:])
+		return fmt.Sprintf("$%d", n+offset)
+	})
+}